@@ -2,12 +2,16 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math"
+	"math/bits"
 	"os"
 	"runtime"
-	"sort"
 	"sync"
 	"syscall"
 )
@@ -16,31 +20,97 @@ type measurement struct {
 	min, max, sum, count int64
 }
 
+func (m *measurement) add(temp int64) {
+	if m.count == 0 {
+		m.min = temp
+		m.max = temp
+		m.sum = temp
+		m.count = 1
+	} else {
+		m.min = min(m.min, temp)
+		m.max = max(m.max, temp)
+		m.sum += temp
+		m.count++
+	}
+}
+
+// options control handling of input that does not follow the 1brc rules
+type options struct {
+	// strict stops at the first malformed line, i.e. also with station name longer than maxNameLength bytes,
+	// lenient skips malformed lines and counts them,
+	// otherwise the input is assumed to be valid
+	strict  bool
+	lenient bool
+
+	// seeded selects seededHash with the seed instead of FNV-1a
+	// to resist names crafted to collide
+	seeded bool
+	seed   uint64
+
+	// chunks is the number of chunks processed in parallel, runtime.NumCPU() by default
+	chunks int
+}
+
+const (
+	// maxNameLength is the maximum station name length in bytes according to the 1brc rules
+	maxNameLength = 100
+
+	// probeLengthFactor times log2 of the table size limits the distance of the entry
+	// from its hash position, it is only exceeded by names that collide for the hash
+	// even after the table grows
+	probeLengthFactor = 32
+)
+
 func main() {
-	if len(os.Args) != 2 {
+	var opts options
+	flag.BoolVar(&opts.strict, "strict", false, fmt.Sprintf("stop at the first malformed line or station name longer than %d bytes", maxNameLength))
+	flag.BoolVar(&opts.lenient, "lenient", false, fmt.Sprintf("skip malformed lines or station names longer than %d bytes and report their counts", maxNameLength))
+	hash := flag.String("hash", "fnv1a", "station name hash: fnv1a or seeded for untrusted input")
+	flag.Parse()
+
+	if opts.strict && opts.lenient {
+		log.Fatalf("Use either -strict or -lenient")
+	}
+
+	switch *hash {
+	case "fnv1a":
+	case "seeded":
+		opts.seeded = true
+		opts.seed = randomSeed()
+	default:
+		log.Fatalf("Unknown hash: %s", *hash)
+	}
+
+	if flag.NArg() != 1 {
 		log.Fatalf("Missing measurements filename")
 	}
 
-	measurements := processFile(os.Args[1])
+	measurements := processFile(flag.Arg(0), opts)
+
+	printMeasurements(os.Stdout, measurements)
+}
 
-	ids := make([]string, 0, len(measurements))
-	for id := range measurements {
-		ids = append(ids, id)
+func randomSeed() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Fatalf("Seed: %v", err)
 	}
-	sort.Strings(ids)
+	return binary.LittleEndian.Uint64(b[:])
+}
 
-	fmt.Print("{")
-	for i, id := range ids {
+func printMeasurements(w io.Writer, measurements *table) {
+	fmt.Fprint(w, "{")
+	for i, e := range measurements.sorted() {
 		if i > 0 {
-			fmt.Print(", ")
+			fmt.Fprint(w, ", ")
 		}
-		m := measurements[id]
-		fmt.Printf("%s=%.1f/%.1f/%.1f", id, round(float64(m.min)/10.0), round(float64(m.sum)/10.0/float64(m.count)), round(float64(m.max)/10.0))
+		m := &e.m
+		fmt.Fprintf(w, "%s=%.1f/%.1f/%.1f", measurements.value(e), round(float64(m.min)/10.0), round(float64(m.sum)/10.0/float64(m.count)), round(float64(m.max)/10.0))
 	}
-	fmt.Println("}")
+	fmt.Fprintln(w, "}")
 }
 
-func processFile(filename string) map[string]*measurement {
+func processFile(filename string, opts options) *table {
 	f, err := os.Open(filename)
 	if err != nil {
 		log.Fatalf("Open: %v", err)
@@ -68,11 +138,23 @@ func processFile(filename string) map[string]*measurement {
 		}
 	}()
 
-	return process(data)
+	measurements, err := process(data, opts)
+	if err != nil {
+		log.Fatalf("Process: %v", err)
+	}
+	for reason, n := range measurements.skipped {
+		if n > 0 {
+			log.Printf("Skipped %d lines: %v", n, malformation(reason))
+		}
+	}
+	return measurements
 }
 
-func process(data []byte) map[string]*measurement {
-	nChunks := runtime.NumCPU()
+func process(data []byte, opts options) (*table, error) {
+	nChunks := opts.chunks
+	if nChunks <= 0 {
+		nChunks = runtime.NumCPU()
+	}
 
 	chunkSize := len(data) / nChunks
 	if chunkSize == 0 {
@@ -101,88 +183,72 @@ func process(data []byte) map[string]*measurement {
 	var wg sync.WaitGroup
 	wg.Add(len(chunks))
 
-	results := make([]map[string]*measurement, len(chunks))
+	results := make([]*table, len(chunks))
 	start := 0
 	for i, chunk := range chunks {
-		go func(data []byte, i int) {
-			results[i] = processChunk(data)
+		go func(data []byte, i, offset int) {
+			if opts.strict || opts.lenient {
+				results[i] = processChunkChecked(data, offset, opts)
+			} else {
+				results[i] = processChunk(data, opts)
+			}
 			wg.Done()
-		}(data[start:chunk], i)
+		}(data[start:chunk], i, start)
 		start = chunk
 	}
 	wg.Wait()
 
-	measurements := make(map[string]*measurement)
+	if len(results) == 0 {
+		return newTable(), nil
+	}
+
+	// chunks stop at the first probe chain over the limit, merging them would be slow
 	for _, r := range results {
-		for id, rm := range r {
-			m := measurements[id]
-			if m == nil {
-				measurements[id] = rm
-			} else {
-				m.min = min(m.min, rm.min)
-				m.max = max(m.max, rm.max)
-				m.sum += rm.sum
-				m.count += rm.count
-			}
+		if r.probeLimitExceeded != nil {
+			return nil, probeLimitError(r, opts)
 		}
 	}
-	return measurements
-}
-
-func processChunk(data []byte) map[string]*measurement {
-	// Use fixed size linear probe lookup table
-	const (
-		// use power of 2 for fast modulo calculation,
-		// should be larger than max number of keys which is 10_000
-		entriesSize = 1 << 14
 
-		// use FNV-1a hash
-		fnv1aOffset64 = 14695981039346656037
-		fnv1aPrime64  = 1099511628211
-	)
-
-	type entry struct {
-		m     measurement
-		hash  uint64
-		vlen  int
-		value [128]byte // use power of 2 > 100 for alignment
+	// merge pairs of tables in parallel
+	for step := 1; step < len(results); step *= 2 {
+		for i := 0; i+step < len(results); i += 2 * step {
+			wg.Add(1)
+			go func(t, other *table) {
+				t.merge(other)
+				wg.Done()
+			}(results[i], results[i+step])
+		}
+		wg.Wait()
 	}
-	entries := make([]entry, entriesSize)
-	entriesCount := 0
 
-	// keep short and inlinable
-	getMeasurement := func(hash uint64, value []byte) *measurement {
-		i := hash & uint64(entriesSize-1)
-		entry := &entries[i]
-
-		// bytes.Equal could be commented to speedup assuming no hash collisions
-		for entry.vlen > 0 && !(entry.hash == hash && bytes.Equal(entry.value[:entry.vlen], value)) {
-			i = (i + 1) & uint64(entriesSize-1)
-			entry = &entries[i]
-		}
+	measurements := results[0]
+	if measurements.probeLimitExceeded != nil {
+		return nil, probeLimitError(measurements, opts)
+	}
+	if err := measurements.err(); err != nil {
+		return nil, err
+	}
+	return measurements, nil
+}
 
-		if entry.vlen == 0 {
-			entry.hash = hash
-			entry.vlen = copy(entry.value[:], value)
-			entriesCount++
-		}
-		return &entry.m
+// probeLimitError reports the name which exceeded the probe length limit of the table,
+// only names colliding for the seeded hash are likely crafted to collide.
+func probeLimitError(t *table, opts options) error {
+	if opts.seeded {
+		return fmt.Errorf("probe length limit of %d exceeded by station name %q with seeded hash, the input may be crafted to collide", t.maxProbeLength(), t.probeLimitExceeded)
 	}
+	return fmt.Errorf("probe length limit of %d exceeded by station name %q with fnv1a hash, try seeded hash", t.maxProbeLength(), t.probeLimitExceeded)
+}
+
+func processChunk(data []byte, opts options) *table {
+	measurements := newTable()
 
 	// assume valid input
 	for len(data) > 0 {
 
-		idHash := uint64(fnv1aOffset64)
-		semiPos := 0
-		for i, b := range data {
-			if b == ';' {
-				semiPos = i
-				break
-			}
-
-			// calculate FNV-1a hash
-			idHash ^= uint64(b)
-			idHash *= fnv1aPrime64
+		semiPos, idHash := scanName(data)
+		if opts.seeded {
+			idHash = seededHash(opts.seed, data[:semiPos])
 		}
 
 		idData := data[:semiPos]
@@ -190,52 +256,141 @@ func processChunk(data []byte) map[string]*measurement {
 		data = data[semiPos+1:]
 
 		var temp int64
-		// parseNumber
-		{
-			negative := data[0] == '-'
-			if negative {
-				data = data[1:]
-			}
-
-			_ = data[3]
-			if data[1] == '.' {
-				// 1.2\n
-				temp = int64(data[0])*10 + int64(data[2]) - '0'*(10+1)
-				data = data[4:]
-				// 12.3\n
+		if len(data) >= 8 {
+			var n int
+			temp, n = parseNumberSWAR(binary.LittleEndian.Uint64(data))
+			data = data[n:]
+		} else {
+			// parseNumber near the end of data, the last line may lack the new line
+			nlPos := bytes.IndexByte(data, '\n')
+			if nlPos == -1 {
+				temp = parseNumber(data)
+				data = data[len(data):]
 			} else {
-				_ = data[4]
-				temp = int64(data[0])*100 + int64(data[1])*10 + int64(data[3]) - '0'*(100+10+1)
-				data = data[5:]
-			}
-
-			if negative {
-				temp = -temp
+				temp = parseNumber(data[:nlPos])
+				data = data[nlPos+1:]
 			}
 		}
 
-		m := getMeasurement(idHash, idData)
-		if m.count == 0 {
-			m.min = temp
-			m.max = temp
-			m.sum = temp
-			m.count = 1
+		var m *measurement
+		if len(idData) <= len(entry{}.value) {
+			m = measurements.get(idHash, idData)
 		} else {
-			m.min = min(m.min, temp)
-			m.max = max(m.max, temp)
-			m.sum += temp
-			m.count++
+			m = measurements.getLong(idHash, idData)
+		}
+		m.add(temp)
+
+		// every further lookup of colliding names probes the long chain,
+		// stop instead of scanning the rest of the chunk quadratically
+		if measurements.probeLimitExceeded != nil {
+			return measurements
 		}
 	}
+	return measurements
+}
+
+const (
+	// use FNV-1a over 8 byte words
+	fnv1aOffset64 = 14695981039346656037
+	fnv1aPrime64  = 1099511628211
+)
+
+// scanName returns position of the first ';' in data and the hash of the name before it.
+// It reads data 8 bytes at a time and hashes each word with FNV-1a,
+// the tail shorter than 8 bytes is read byte by byte into the same word.
+// Multiplication only carries differences of the last word towards high bits,
+// fmix64 spreads them over the low bits that index the table.
+func scanName(data []byte) (int, uint64) {
+	const (
+		ones  = 0x0101010101010101
+		highs = 0x8080808080808080
+		semis = ';' * ones
+	)
 
-	result := make(map[string]*measurement, entriesCount)
-	for i := range entries {
-		entry := &entries[i]
-		if entry.m.count > 0 {
-			result[string(entry.value[:entry.vlen])] = &entry.m
+	hash := uint64(fnv1aOffset64)
+	i := 0
+	for ; i+8 <= len(data); i += 8 {
+		word := binary.LittleEndian.Uint64(data[i:])
+
+		// find zero byte in word^semis, see https://graphics.stanford.edu/~seander/bithacks.html#ZeroInWord
+		x := word ^ semis
+		if found := (x - ones) &^ x & highs; found != 0 {
+			n := bits.TrailingZeros64(found) / 8
+			word &= 1<<(8*n) - 1
+			return i + n, fmix64((hash ^ word) * fnv1aPrime64)
 		}
+		hash = (hash ^ word) * fnv1aPrime64
 	}
-	return result
+
+	var word uint64
+	for j := i; j < len(data); j++ {
+		if data[j] == ';' {
+			return j, fmix64((hash ^ word) * fnv1aPrime64)
+		}
+		word |= uint64(data[j]) << (8 * (j - i))
+	}
+	return -1, 0
+}
+
+// parseNumberSWAR reads decimal number that matches "^-?[0-9]{1,2}[.][0-9]\n" pattern
+// from the little endian word without branches and returns the value*10 like parseNumber
+// and the length of the number including the new line.
+// See https://github.com/gunnarmorling/1brc/discussions/138
+func parseNumberSWAR(word uint64) (int64, int) {
+	// '.' is the only byte without 0x10 bit among the 2nd, 3rd and 4th bytes
+	dotPos := bits.TrailingZeros64(^word & 0x10101000)
+
+	// -1 for '-' which does not have 0x10 bit, 0 for digit
+	negative := int64(^word<<59) >> 63
+
+	// drop the sign and align hundreds, tens and ones digits at the 2nd, 3rd and 5th bytes
+	digits := ((word &^ uint64(negative&0xff)) << (28 - dotPos)) & 0x0f000f0f00
+
+	// hundreds*100 + tens*10 + ones at bits 32-41
+	abs := int64(((digits * (100<<24 + 10<<16 + 1)) >> 32) & 0x3ff)
+
+	return (abs ^ negative) - negative, dotPos/8 + 3
+}
+
+// seededHash is a wyhash inspired hash of the data keyed by the seed,
+// names that collide for one seed are unlikely to collide for another.
+func seededHash(seed uint64, data []byte) uint64 {
+	const (
+		p0 = 0xa0761d6478bd642f
+		p1 = 0xe7037ed1a0b428db
+		p2 = 0x8ebc6af09c88c6e3
+	)
+
+	h := seed ^ p0
+	n := uint64(len(data))
+	for len(data) >= 8 {
+		h = mum(binary.LittleEndian.Uint64(data)^seed^p1, h^p2)
+		data = data[8:]
+	}
+
+	var tail uint64
+	for i, b := range data {
+		tail |= uint64(b) << (8 * i)
+	}
+	h = mum(tail^seed^p1, h^p2)
+
+	return mum(h^n, p0^seed)
+}
+
+// fmix64 is the MurmurHash3 finalizer, every bit of h affects every bit of the result
+func fmix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// mum multiplies a and b into 128 bits and folds the result
+func mum(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	return hi ^ lo
 }
 
 func round(x float64) float64 {
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestRoundJava(t *testing.T) {
@@ -49,6 +57,418 @@ func TestParseNumber(t *testing.T) {
 	}
 }
 
+func TestParseNumberSWAR(t *testing.T) {
+	for value := -999; value <= 999; value++ {
+		number := fmt.Sprintf("%.1f", float64(value)/10)
+		if value == 0 {
+			number = "-0.0"
+		}
+		for _, number := range []string{number, strings.TrimPrefix(number, "-")} {
+			expected := parseNumber([]byte(number))
+
+			// the rest of the word may contain the next line
+			for _, rest := range []string{"\n\n\n\n\n", "\nHamburg", "\n-9;.\xff"} {
+				data := []byte(number + rest)
+				temp, n := parseNumberSWAR(binary.LittleEndian.Uint64(data))
+				if temp != expected || n != len(number)+1 {
+					t.Errorf("Wrong parsing of %q, expected: %d, %d, got: %d, %d", data, expected, len(number)+1, temp, n)
+				}
+			}
+		}
+	}
+}
+
+func TestScanName(t *testing.T) {
+	for n := 0; n <= 130; n++ {
+		name := []byte(strings.Repeat("ä", n/2) + strings.Repeat("x", n%2))
+
+		expectedPos := len(name)
+		_, expectedHash := scanName(append(name, ';'))
+
+		// hash does not depend on data after the name
+		for _, rest := range []string{";", ";1.0\n", ";-12.3\nSomewhere;1.0\n"} {
+			data := append(name[:len(name):len(name)], rest...)
+			semiPos, hash := scanName(data)
+			if semiPos != expectedPos || hash != expectedHash {
+				t.Errorf("Wrong scan of %q, expected: %d %x, got: %d %x", data, expectedPos, expectedHash, semiPos, hash)
+			}
+		}
+	}
+
+	if semiPos, _ := scanName([]byte("no semicolon")); semiPos != -1 {
+		t.Errorf("Expected -1, got: %d", semiPos)
+	}
+
+	// names of the same length differing in one byte
+	hashes := make(map[uint64]string)
+	for _, name := range []string{"Hamburg", "Hamburh", "Bulawayo", "Bulawayp", "Las Palmas de Gran Canaria", "Las Palmas de Gran Canarib"} {
+		_, hash := scanName([]byte(name + ";"))
+		if other, ok := hashes[hash]; ok {
+			t.Errorf("Hash collision of %s and %s", name, other)
+		}
+		hashes[hash] = name
+	}
+}
+
+func TestProcessSamples(t *testing.T) {
+	samples, err := filepath.Glob("../../../test/resources/samples/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// inputs beyond the 1brc rules
+	testdata, err := filepath.Glob("testdata/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sample := range append(samples, testdata...) {
+		t.Run(filepath.Base(sample), func(t *testing.T) {
+			data, err := os.ReadFile(sample)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := os.ReadFile(strings.TrimSuffix(sample, ".txt") + ".out")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, opts := range []options{
+				{},
+				{seeded: true, seed: 42},
+				{chunks: 3},
+				{seeded: true, seed: 42, chunks: 16},
+				{strict: true, chunks: 3},
+				{lenient: true, chunks: 3},
+			} {
+				measurements, err := process(data, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var out bytes.Buffer
+				printMeasurements(&out, measurements)
+				if out.String() != string(expected) {
+					t.Errorf("Wrong output with %+v, expected:\n%s\ngot:\n%s", opts, expected, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestProcessLongNames(t *testing.T) {
+	// names longer than the inline value that differ only after it
+	prefix := strings.Repeat("x", 128)
+	long1 := prefix + strings.Repeat("1", 200)
+	long2 := prefix + strings.Repeat("2", 200)
+	data := []byte(long1 + ";1.0\n" + prefix + ";2.0\n" + long2 + ";3.0\n" + long1 + ";5.0\n")
+
+	for _, opts := range []options{{chunks: 1}, {chunks: 2}, {chunks: 4}} {
+		t.Run(fmt.Sprintf("%+v", opts), func(t *testing.T) {
+			table, err := process(data, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			measurements := toMap(table)
+			for _, tc := range []struct {
+				id    string
+				sum   int64
+				count int64
+			}{
+				{id: long1, sum: 60, count: 2},
+				{id: prefix, sum: 20, count: 1},
+				{id: long2, sum: 30, count: 1},
+			} {
+				if m := measurements[tc.id]; m == nil || m.sum != tc.sum || m.count != tc.count {
+					t.Errorf("Wrong measurement of %d bytes long name, expected sum: %d, count: %d, got: %v", len(tc.id), tc.sum, tc.count, m)
+				}
+			}
+			if len(measurements) != 3 {
+				t.Errorf("Wrong number of measurements, expected: 3, got: %d", len(measurements))
+			}
+		})
+	}
+}
+
+func TestProcessStrict(t *testing.T) {
+	name := strings.Repeat("x", maxNameLength)
+	data := []byte(name + ";1.0\n")
+	if _, err := process(data, options{strict: true}); err != nil {
+		t.Errorf("Unexpected error for %d bytes long name: %v", len(name), err)
+	}
+
+	name += "y"
+	data = append(data, name+";1.0\n"...)
+	for _, chunks := range []int{1, 2} {
+		if _, err := process(data, options{strict: true, chunks: chunks}); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("Expected error for %d bytes long name in %d chunks, got: %v", len(name), chunks, err)
+		}
+	}
+	if _, err := process(data, options{}); err != nil {
+		t.Errorf("Unexpected error in non-strict mode: %v", err)
+	}
+}
+
+func TestProcessMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		data     string
+		expected string
+		skipped  [numMalformations]int64
+	}{
+		{
+			data:     "a;1.0\nb\nc;2.0\n",
+			expected: `malformed line at offset 6: missing ';': "b"`,
+			skipped:  [numMalformations]int64{missingSeparator: 1},
+		},
+		{
+			data:     "a;1.0\n\nb;\n;1.0\n",
+			expected: `malformed line at offset 6: empty line: ""`,
+			skipped:  [numMalformations]int64{emptyLine: 1, invalidTemperature: 1, emptyName: 1},
+		},
+		{
+			data:     "a;1.0\nb;12.34\nb;1.x\nb;+1.0\nb;1.0",
+			expected: `malformed line at offset 6: invalid temperature: "b;12.34"`,
+			skipped:  [numMalformations]int64{invalidTemperature: 3},
+		},
+		{
+			data:     "a;1.0\nb;1.0\nc;2.0\nd;123.4",
+			expected: `malformed line at offset 18: invalid temperature: "d;123.4"`,
+			skipped:  [numMalformations]int64{invalidTemperature: 1},
+		},
+		{
+			data:     "a;1.0\n" + strings.Repeat("x", maxNameLength+1) + ";1.0\nb;1.0\n" + strings.Repeat("y", 300) + ";2.0\n",
+			expected: `malformed line at offset 6: station name longer than 100 bytes: "` + strings.Repeat("x", maxNameLength+1) + `;1.0"`,
+			skipped:  [numMalformations]int64{nameTooLong: 2},
+		},
+	} {
+		for _, chunks := range []int{1, 2, 3} {
+			_, err := process([]byte(tc.data), options{strict: true, chunks: chunks})
+			if err == nil || err.Error() != tc.expected {
+				t.Errorf("Wrong error for %q in %d chunks, expected: %s, got: %v", tc.data, chunks, tc.expected, err)
+			}
+
+			measurements, err := process([]byte(tc.data), options{lenient: true, chunks: chunks})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if measurements.skipped != tc.skipped {
+				t.Errorf("Wrong skipped lines for %q in %d chunks, expected: %v, got: %v", tc.data, chunks, tc.skipped, measurements.skipped)
+			}
+			if m := toMap(measurements)["a"]; m == nil || m.count != 1 {
+				t.Errorf("Wrong measurement of a for %q in %d chunks: %v", tc.data, chunks, m)
+			}
+		}
+	}
+}
+
+func TestProcessMissingLastNewLine(t *testing.T) {
+	for _, data := range []string{"a;1.0\nb;2.5", "a;1.0\nb;-2.5", "a;1.0\nb;12.5", "a;1.0\nb;-12.5"} {
+		_, value, _ := strings.Cut(data[len("a;1.0\n"):], ";")
+		for _, chunks := range []int{1, 2, 3} {
+			measurements, err := process([]byte(data), options{chunks: chunks})
+			if err != nil {
+				t.Fatal(err)
+			}
+			result := toMap(measurements)
+			if m := result["b"]; m == nil || m.count != 1 || m.sum != parseNumber([]byte(value)) {
+				t.Errorf("Wrong measurement of b for %q in %d chunks: %v", data, chunks, m)
+			}
+			if m := result["a"]; m == nil || m.count != 1 || m.sum != 10 {
+				t.Errorf("Wrong measurement of a for %q in %d chunks: %v", data, chunks, m)
+			}
+		}
+	}
+}
+
+func TestParseNumberChecked(t *testing.T) {
+	for value := -999; value <= 999; value++ {
+		number := fmt.Sprintf("%.1f", float64(value)/10)
+		if temp, ok := parseNumberChecked([]byte(number)); !ok || temp != int64(value) {
+			t.Errorf("Wrong parsing of %s, expected: %d, got: %d, %v", number, value, temp, ok)
+		}
+	}
+
+	for _, value := range []string{"", "-", "1", "1.", ".1", "-.1", "1.23", "123.4", "+1.2", "a.1", "1.a", "1a.2", "--1.2", "1.2\r", "-0.0.0"} {
+		if temp, ok := parseNumberChecked([]byte(value)); ok {
+			t.Errorf("Expected parsing of %q to fail, got: %d", value, temp)
+		}
+	}
+}
+
+func TestTableMerge(t *testing.T) {
+	data, err := os.ReadFile("../../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := toMap(processChunk(data, options{}))
+
+	// each table gets every other line
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	var parts [2][]byte
+	for i, line := range lines {
+		parts[i%2] = append(parts[i%2], line...)
+	}
+	measurements := processChunk(parts[0], options{})
+	other := processChunk(parts[1], options{})
+	measurements.merge(other)
+
+	t2 := processChunk(parts[0], options{})
+	if allocs := testing.AllocsPerRun(10, func() { t2.merge(other) }); allocs != 0 {
+		t.Errorf("Expected no allocations, got: %v", allocs)
+	}
+
+	got := toMap(measurements)
+	if len(got) != len(expected) {
+		t.Errorf("Wrong number of measurements, expected: %d, got: %d", len(expected), len(got))
+	}
+	for id, m := range expected {
+		if *got[id] != *m {
+			t.Errorf("Wrong measurement of %s, expected: %v, got: %v", id, m, got[id])
+		}
+	}
+}
+
+// collidingNames returns n names which FNV-1a hashes fall into the first 64 entries of the initial table
+func collidingNames(n int) []string {
+	var names []string
+	for i := 0; len(names) < n; i++ {
+		name := fmt.Sprintf("s%d", i)
+		if _, hash := scanName([]byte(name + ";")); hash&(1<<14-1) < 64 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func TestProcessProbeLimit(t *testing.T) {
+	// names collide in the initial table and in the grown one
+	n := 4 * int(newTable().maxProbeLength())
+	var data []byte
+	for _, name := range collidingNames(n) {
+		data = append(data, name+";1.0\n"...)
+	}
+
+	if _, err := process(data, options{}); err == nil || !strings.Contains(err.Error(), "probe length limit") || strings.Contains(err.Error(), "crafted") {
+		t.Errorf("Expected probe length limit error suggesting seeded hash, got: %v", err)
+	}
+
+	measurements, err := process(data, options{seeded: true, seed: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if measurements.count != n {
+		t.Errorf("Wrong number of measurements, expected: %d, got: %d", n, measurements.count)
+	}
+}
+
+func TestProcessProbeLimitGrows(t *testing.T) {
+	// names collide in the initial table but split in half in the grown one
+	n := 3 * int(newTable().maxProbeLength()) / 2
+	var data []byte
+	for _, name := range collidingNames(n) {
+		data = append(data, name+";1.0\n"...)
+	}
+
+	measurements, err := process(data, options{chunks: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if measurements.count != n || len(measurements.entries) != 2*entriesSize {
+		t.Errorf("Expected %d measurements in grown table, got %d in table of %d", n, measurements.count, len(measurements.entries))
+	}
+}
+
+func TestProcessProbeLimitStopsEarly(t *testing.T) {
+	// rows of many colliding names would take minutes if chunks kept probing after the limit
+	names := collidingNames(4000)
+	var data []byte
+	for i := 0; i < 1000; i++ {
+		for _, name := range names {
+			data = append(data, name+";1.0\n"...)
+		}
+	}
+
+	for _, opts := range []options{{chunks: 1}, {chunks: 4}, {chunks: 1, strict: true}, {chunks: 1, lenient: true}} {
+		done := make(chan error, 1)
+		go func() {
+			_, err := process(data, opts)
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			if err == nil || !strings.Contains(err.Error(), "probe length limit") {
+				t.Errorf("Expected probe length limit error with %+v, got: %v", opts, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Expected probe length limit error with %+v before timeout", opts)
+		}
+	}
+}
+
+func TestProcessSequentialNames(t *testing.T) {
+	// names differing in trailing digits must not cluster in the default hash
+	const n = 200_000
+	var data []byte
+	for i := 0; i < n; i++ {
+		data = fmt.Appendf(data, "sensor-%d;1.0\n", i)
+	}
+
+	for _, chunks := range []int{1, 4} {
+		measurements, err := process(data, options{chunks: chunks})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if measurements.count != n || measurements.probeGrown {
+			t.Errorf("Expected %d measurements without probe length growth, got %d, grown: %v", n, measurements.count, measurements.probeGrown)
+		}
+	}
+}
+
+func TestSeededHash(t *testing.T) {
+	a, b := []byte("Hamburg"), []byte("Bulawayo")
+	if seededHash(1, a) != seededHash(1, a) {
+		t.Errorf("Expected the same hash for the same seed")
+	}
+	if seededHash(1, a) == seededHash(2, a) {
+		t.Errorf("Expected different hashes for different seeds")
+	}
+	if seededHash(1, a) == seededHash(1, b) {
+		t.Errorf("Expected different hashes for different names")
+	}
+	// names differing only in length
+	if seededHash(1, []byte("a")) == seededHash(1, []byte("a\x00")) {
+		t.Errorf("Expected different hashes for names of different length")
+	}
+}
+
+var hashSink uint64
+
+func BenchmarkHash(b *testing.B) {
+	for _, name := range []string{"Oslo", "Palmerston North", "Las Palmas de Gran Canaria"} {
+		data := []byte(name + ";1.0\n")
+
+		b.Run(name+"/fnv1a", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, hashSink = scanName(data)
+			}
+		})
+
+		b.Run(name+"/seeded", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				semiPos, _ := scanName(data)
+				hashSink = seededHash(42, data[:semiPos])
+			}
+		})
+	}
+}
+
+func toMap(t *table) map[string]*measurement {
+	result := make(map[string]*measurement, t.count)
+	for _, e := range t.sorted() {
+		result[string(t.value(e))] = &e.m
+	}
+	return result
+}
+
 var parseNumberSink int64
 
 func BenchmarkParseNumber(b *testing.B) {
@@ -60,27 +480,115 @@ func BenchmarkParseNumber(b *testing.B) {
 	}
 }
 
-func BenchmarkProcess(b *testing.B) {
-	// $ ./create_measurements.sh 1000000 && mv measurements.txt measurements-1e6.txt
-	// Created file with 1,000,000 measurements in 514 ms
-	const filename = "../../../../measurements-1e6.txt"
-
-	data, err := os.ReadFile(filename)
+// generateMeasurements returns rows of measurements of the first unique stations from data/weather_stations.csv
+// with names padded by '_' to nameLength bytes and temperatures normally distributed around the station means.
+// It uses the fixed seed to return the same data for the same arguments.
+func generateMeasurements(tb testing.TB, stations, nameLength, rows int) []byte {
+	csv, err := os.ReadFile("../../../../data/weather_stations.csv")
 	if err != nil {
-		b.Fatal(err)
+		tb.Fatal(err)
+	}
+
+	type station struct {
+		name string
+		mean float64
+	}
+	var list []station
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(csv), "\n") {
+		name, mean, ok := strings.Cut(line, ";")
+		if !ok || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if len(name) < nameLength {
+			name += strings.Repeat("_", nameLength-len(name))
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		m, err := strconv.ParseFloat(mean, 64)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		list = append(list, station{name, m})
+		if len(list) == stations {
+			break
+		}
+	}
+	if len(list) < stations {
+		tb.Fatalf("Not enough stations, expected: %d, got: %d", stations, len(list))
 	}
 
-	measurements := process(data)
-	rows := int64(0)
-	for _, m := range measurements {
-		rows += m.count
+	r := rand.New(rand.NewSource(1))
+	var data []byte
+	for i := 0; i < rows; i++ {
+		s := list[r.Intn(len(list))]
+		temp := max(-999, min(999, math.Round((s.mean+10*r.NormFloat64())*10)))
+		data = append(data, s.name...)
+		data = append(data, ';')
+		data = strconv.AppendFloat(data, temp/10, 'f', 1, 64)
+		data = append(data, '\n')
 	}
+	return data
+}
 
-	b.ReportAllocs()
-	b.ResetTimer()
-	b.ReportMetric(float64(rows), "rows/op")
+func BenchmarkProcess(b *testing.B) {
+	const rows = 1_000_000
 
-	for i := 0; i < b.N; i++ {
-		process(data)
+	for _, bc := range []struct {
+		name       string
+		stations   int
+		nameLength int
+		opts       options
+	}{
+		{name: "stations=10", stations: 10},
+		{name: "stations=413", stations: 413},
+		{name: "stations=10000", stations: 10_000},
+		{name: "stations=413/name=32", stations: 413, nameLength: 32},
+		{name: "stations=413/name=100", stations: 413, nameLength: 100},
+		{name: "stations=10000/chunks=1", stations: 10_000, opts: options{chunks: 1}},
+		{name: "stations=10000/chunks=4", stations: 10_000, opts: options{chunks: 4}},
+		{name: "stations=10000/chunks=16", stations: 10_000, opts: options{chunks: 16}},
+		{name: "stations=413/seeded", stations: 413, opts: options{seeded: true, seed: 42}},
+		{name: "stations=413/strict", stations: 413, opts: options{strict: true}},
+		{name: "stations=413/lenient", stations: 413, opts: options{lenient: true}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			data := generateMeasurements(b, bc.stations, bc.nameLength, rows)
+
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ReportMetric(rows, "rows/op")
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := process(data, bc.opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMerge(b *testing.B) {
+	data, err := os.ReadFile("../../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	other := processChunk(data, options{})
+
+	for _, tables := range []int{2, 8, 32} {
+		b.Run(fmt.Sprintf("tables=%d", tables), func(b *testing.B) {
+			b.ReportAllocs()
+			t := processChunk(data, options{})
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 1; j < tables; j++ {
+					t.merge(other)
+				}
+			}
+		})
 	}
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// malformation is a category of the line that does not follow the 1brc rules
+type malformation int
+
+const (
+	emptyLine malformation = iota
+	missingSeparator
+	emptyName
+	nameTooLong
+	invalidTemperature
+
+	numMalformations
+)
+
+func (m malformation) String() string {
+	switch m {
+	case emptyLine:
+		return "empty line"
+	case missingSeparator:
+		return "missing ';'"
+	case emptyName:
+		return "empty station name"
+	case nameTooLong:
+		return fmt.Sprintf("station name longer than %d bytes", maxNameLength)
+	case invalidTemperature:
+		return "invalid temperature"
+	}
+	return fmt.Sprintf("malformation(%d)", int(m))
+}
+
+// malformedLine is the first malformed line found in strict mode
+type malformedLine struct {
+	offset int
+	line   []byte
+	reason malformation
+}
+
+func (l *malformedLine) Error() string {
+	return fmt.Sprintf("malformed line at offset %d: %v: %q", l.offset, l.reason, l.line)
+}
+
+// processChunkChecked is processChunk that validates every line of data located at the offset of the input.
+// In strict mode it stops at the first malformed line, otherwise it skips malformed lines and counts them.
+// The last line may lack the new line.
+func processChunkChecked(data []byte, offset int, opts options) *table {
+	measurements := newTable()
+
+	for pos := 0; pos < len(data); {
+		line := data[pos:]
+		next := len(data)
+		if nlPos := bytes.IndexByte(line, '\n'); nlPos != -1 {
+			line = line[:nlPos]
+			next = pos + nlPos + 1
+		}
+
+		semiPos, idHash := scanName(line)
+		var temp int64
+		reason := malformation(-1)
+		switch {
+		case len(line) == 0:
+			reason = emptyLine
+		case semiPos == -1:
+			reason = missingSeparator
+		case semiPos == 0:
+			reason = emptyName
+		case semiPos > maxNameLength:
+			reason = nameTooLong
+		default:
+			var ok bool
+			if temp, ok = parseNumberChecked(line[semiPos+1:]); !ok {
+				reason = invalidTemperature
+			}
+		}
+
+		if reason >= 0 {
+			if opts.strict {
+				measurements.malformed = &malformedLine{offset: offset + pos, line: line, reason: reason}
+				return measurements
+			}
+			measurements.skipped[reason]++
+			pos = next
+			continue
+		}
+
+		idData := line[:semiPos]
+		if opts.seeded {
+			idHash = seededHash(opts.seed, idData)
+		}
+		measurements.getLong(idHash, idData).add(temp)
+		if measurements.probeLimitExceeded != nil {
+			return measurements
+		}
+		pos = next
+	}
+	return measurements
+}
+
+// parseNumberChecked is parseNumber that returns false unless data matches "^-?[0-9]{1,2}[.][0-9]$" pattern
+func parseNumberChecked(data []byte) (int64, bool) {
+	digits := data
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+	}
+	switch len(digits) {
+	case 3:
+		if !isDigit(digits[0]) || digits[1] != '.' || !isDigit(digits[2]) {
+			return 0, false
+		}
+	case 4:
+		if !isDigit(digits[0]) || !isDigit(digits[1]) || digits[2] != '.' || !isDigit(digits[3]) {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+	return parseNumber(data), true
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
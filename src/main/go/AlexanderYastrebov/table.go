@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/bits"
+	"sort"
+)
+
+// table is a linear probe lookup table of measurements by station name
+type table struct {
+	entries []entry
+	mask    uint64
+	count   int
+
+	// values longer than the inline value, e.g. names over the 100 bytes max,
+	// are stored in the arena at the offset kept in the entry value
+	arena []byte
+
+	// the table grows once when the probe length limit is exceeded
+	// and keeps the value that exceeds it again
+	probeGrown         bool
+	probeLimitExceeded []byte
+
+	// first malformed line in strict mode and counts of skipped lines otherwise
+	malformed *malformedLine
+	skipped   [numMalformations]int64
+}
+
+type entry struct {
+	m     measurement
+	hash  uint64
+	vlen  int
+	value [128]byte // use power of 2 > 100 for alignment, holds arena offset of longer values
+}
+
+const (
+	// use power of 2 for fast modulo calculation,
+	// should be larger than max number of keys which is 10_000
+	entriesSize = 1 << 14
+
+	// grow the table once it is 3/4 full to keep probing short,
+	// i.e. only for inputs with more keys than the 10_000 max
+	maxLoadNum = 3
+	maxLoadDen = 4
+)
+
+func newTable() *table {
+	return &table{
+		entries: make([]entry, entriesSize),
+		mask:    entriesSize - 1,
+	}
+}
+
+func (t *table) value(e *entry) []byte {
+	if e.vlen <= len(e.value) {
+		return e.value[:e.vlen]
+	}
+	off := binary.LittleEndian.Uint64(e.value[:])
+	return t.arena[off : off+uint64(e.vlen)]
+}
+
+// maxProbeLength limits the distance of the entry from its hash position
+func (t *table) maxProbeLength() uint64 {
+	return probeLengthFactor * uint64(bits.TrailingZeros(uint(len(t.entries))))
+}
+
+func (t *table) grow() {
+	old := t.entries
+	t.entries = make([]entry, 2*len(old))
+	t.mask = uint64(len(t.entries) - 1)
+	for i := range old {
+		if old[i].vlen > 0 {
+			j := old[i].hash & t.mask
+			for t.entries[j].vlen > 0 {
+				j = (j + 1) & t.mask
+			}
+			t.entries[j] = old[i]
+		}
+	}
+}
+
+// insert finds the free entry for the new value, growing the table if needed
+func (t *table) insert(i uint64, hash uint64, value []byte) *entry {
+	// lookups of the value probe the same distance,
+	// growing splits clusters of hashes that differ in the next bit
+	grow := t.count >= len(t.entries)/maxLoadDen*maxLoadNum
+	if !grow && (i-hash)&t.mask > t.maxProbeLength() && !t.probeGrown {
+		grow, t.probeGrown = true, true
+	}
+	if grow {
+		t.grow()
+		i = hash & t.mask
+		for t.entries[i].vlen > 0 {
+			i = (i + 1) & t.mask
+		}
+	}
+	if (i-hash)&t.mask > t.maxProbeLength() && t.probeLimitExceeded == nil {
+		t.probeLimitExceeded = value
+	}
+	t.count++
+	e := &t.entries[i]
+	e.hash = hash
+	return e
+}
+
+// get returns measurement of the value that fits the inline value, keep short and inlinable
+func (t *table) get(hash uint64, value []byte) *measurement {
+	i := hash & t.mask
+	e := &t.entries[i]
+
+	// bytes.Equal could be commented to speedup assuming no hash collisions,
+	// vlen check skips long values stored in the arena
+	for e.vlen > 0 && !(e.hash == hash && e.vlen == len(value) && bytes.Equal(e.value[:e.vlen], value)) {
+		i = (i + 1) & t.mask
+		e = &t.entries[i]
+	}
+
+	if e.vlen == 0 {
+		e = t.insert(i, hash, value)
+		e.vlen = copy(e.value[:], value)
+	}
+	return &e.m
+}
+
+// getLong returns measurement of the value of any length
+func (t *table) getLong(hash uint64, value []byte) *measurement {
+	i := hash & t.mask
+	e := &t.entries[i]
+
+	for e.vlen > 0 && !(e.hash == hash && bytes.Equal(t.value(e), value)) {
+		i = (i + 1) & t.mask
+		e = &t.entries[i]
+	}
+
+	if e.vlen == 0 {
+		e = t.insert(i, hash, value)
+		if len(value) <= len(e.value) {
+			e.vlen = copy(e.value[:], value)
+		} else {
+			binary.LittleEndian.PutUint64(e.value[:], uint64(len(t.arena)))
+			e.vlen = len(value)
+			t.arena = append(t.arena, value...)
+		}
+	}
+	return &e.m
+}
+
+// merge adds measurements of the other table that must use the same hash,
+// it does not allocate unless the table grows or gets long values.
+func (t *table) merge(other *table) {
+	// entries of the larger table in order would cluster in the smaller one
+	for len(t.entries) < len(other.entries) {
+		t.grow()
+	}
+
+	// visit entries in scattered order as inserting them in order of slots
+	// puts the later ones at the end of clusters which exceeds probe length limit,
+	// odd stride visits every slot of power of 2 sized table
+	const stride = 0x9e3779b97f4a7c15
+	for i, j := 0, uint64(0); i < len(other.entries); i, j = i+1, (j+stride)&other.mask {
+		oe := &other.entries[j]
+		if oe.vlen == 0 {
+			continue
+		}
+
+		m := t.getLong(oe.hash, other.value(oe))
+		if m.count == 0 {
+			*m = oe.m
+		} else {
+			m.min = min(m.min, oe.m.min)
+			m.max = max(m.max, oe.m.max)
+			m.sum += oe.m.sum
+			m.count += oe.m.count
+		}
+	}
+
+	if t.probeLimitExceeded == nil {
+		t.probeLimitExceeded = other.probeLimitExceeded
+	}
+	// keep the first malformed line assuming the other table follows this one
+	if t.malformed == nil {
+		t.malformed = other.malformed
+	}
+	for i, n := range other.skipped {
+		t.skipped[i] += n
+	}
+}
+
+func (t *table) err() error {
+	if t.malformed != nil {
+		return t.malformed
+	}
+	return nil
+}
+
+// sorted returns entries sorted by value
+func (t *table) sorted() []*entry {
+	result := make([]*entry, 0, t.count)
+	for i := range t.entries {
+		if t.entries[i].vlen > 0 {
+			result = append(result, &t.entries[i])
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return bytes.Compare(t.value(result[i]), t.value(result[j])) < 0
+	})
+	return result
+}
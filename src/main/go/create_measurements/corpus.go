@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// corpus is a hostile but valid input with its expected result
+type corpus struct {
+	name     string
+	stations []station
+	rows     []measurement
+	ids      map[string]int // index of the station by name
+}
+
+// measurement of the station with the index in corpus stations
+type measurement struct {
+	id int
+	t  int64 // tenths of a degree
+}
+
+// add adds the measurement of the station with the name, adding the station if needed
+func (c *corpus) add(name string, t int64) {
+	id, ok := c.ids[name]
+	if !ok {
+		if c.ids == nil {
+			c.ids = make(map[string]int)
+		}
+		id = len(c.stations)
+		c.ids[name] = id
+		c.stations = append(c.stations, station{name: name})
+	}
+	c.rows = append(c.rows, measurement{id, t})
+}
+
+// write writes measurements-<name>.txt and the expected result into measurements-<name>.out in the dir
+func (c *corpus) write(dir string) error {
+	name := filepath.Join(dir, "measurements-"+c.name)
+
+	f, err := os.Create(name + ".txt")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	results := make([]stats, len(c.stations))
+	var buf []byte
+	for _, m := range c.rows {
+		buf = append(buf[:0], c.stations[m.id].name...)
+		buf = append(buf, ';')
+		buf = appendTenths(buf, m.t)
+		buf = append(buf, '\n')
+		w.Write(buf)
+		results[m.id].add(m.t)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return writeExpectedFile(name+".out", c.stations, results)
+}
+
+// adversarialCorpora returns inputs that stress chunking, parsing and hashing of implementations
+// running with the number of workers, stations are used for the corpus of 10,000 stations.
+func adversarialCorpora(stations []station, workers int, seed uint64) ([]*corpus, error) {
+	r := rand.New(rand.NewPCG(seed, 0))
+
+	corpora := chunkBoundaryCorpora(r, workers)
+	corpora = append(corpora,
+		utf8NamesCorpus(r),
+		lastByteCorpus(r),
+		fnv1aCollisionsCorpus(r),
+		allValuesCorpus(r),
+	)
+
+	c, err := maxStationsCorpus(r, stations)
+	if err != nil {
+		return nil, err
+	}
+	return append(corpora, c), nil
+}
+
+const maxNameLength = 100
+
+// runes of 1 to 4 bytes long UTF-8 encoding
+var runesByLength = [][]rune{
+	[]rune("aZ0 -'.()"),
+	[]rune("äßéйΩ"),
+	[]rune("€中ह가ก"),
+	[]rune("𝔸😀𐍈𠜎"),
+}
+
+// utf8Name returns a random name of exactly n bytes made of multi-byte characters where possible
+func utf8Name(r *rand.Rand, n int) string {
+	var b []byte
+	for len(b) < n {
+		size := 1 + r.IntN(min(4, n-len(b)))
+		runes := runesByLength[size-1]
+		b = utf8.AppendRune(b, runes[r.IntN(len(runes))])
+	}
+	return string(b)
+}
+
+// paddingLines adds 3 lines of total size to the corpus. Each line is a "padNNNN" name
+// padded with '_' and ";1.0\n", so size must be within [3*(7+5), 3*(100+5)] = [36, 315],
+// chunkBoundaryCorpora passes 108 to 214.
+func paddingLines(c *corpus, size int) {
+	const lineExtra = len(";1.0\n")
+	for lines := 3; lines > 0; lines-- {
+		n := size / lines
+		if lines == 1 {
+			n = size
+		}
+		name := fmt.Sprintf("pad%04d", len(c.rows))
+		c.add(name+strings.Repeat("_", n-lineExtra-len(name)), 10)
+		size -= n
+	}
+}
+
+// chunkBoundaryCorpora returns a corpus for every offset within a 107 bytes long line,
+// i.e. 100 bytes name and 5 bytes temperature, so that splitting the corpus into workers chunks
+// of size/workers bytes puts every chunk boundary at that offset of a line.
+func chunkBoundaryCorpora(r *rand.Rand, workers int) []*corpus {
+	const (
+		lineSize      = maxNameLength + len(";-12.3\n")
+		linesPerChunk = 3
+	)
+	workers = max(1, workers)
+
+	names := make([]string, 7)
+	for i := range names {
+		names[i] = utf8Name(r, maxNameLength)
+	}
+
+	var corpora []*corpus
+	for offset := 0; offset < lineSize; offset++ {
+		// the corpus of workers*linesPerChunk*lineSize bytes consists of
+		// padding of 2*lineSize-offset bytes, lines of lineSize bytes and padding of lineSize+offset bytes,
+		// so chunk boundaries at multiples of linesPerChunk*lineSize are at the offset of a line
+		c := &corpus{name: fmt.Sprintf("chunk-boundary-w%d-o%03d", workers, offset)}
+		paddingLines(c, 2*lineSize-offset)
+		for range workers*linesPerChunk - 3 {
+			c.add(names[r.IntN(len(names))], -100-r.Int64N(900))
+		}
+		paddingLines(c, lineSize+offset)
+		corpora = append(corpora, c)
+	}
+	return corpora
+}
+
+// utf8NamesCorpus returns 100 bytes long names of multi-byte characters
+func utf8NamesCorpus(r *rand.Rand) *corpus {
+	c := &corpus{name: "utf8-names"}
+	for i := range 1000 {
+		// names made of characters of the same length and of mixed ones
+		var name string
+		if runes := runesByLength[1+i%3]; i%2 == 0 {
+			var b []byte
+			for len(b)+utf8.RuneLen(runes[0]) <= maxNameLength {
+				b = utf8.AppendRune(b, runes[r.IntN(len(runes))])
+			}
+			name = string(b) + strings.Repeat("x", maxNameLength-len(b))
+		} else {
+			name = utf8Name(r, maxNameLength)
+		}
+		for range 1 + r.IntN(3) {
+			c.add(name, randomTenths(r))
+		}
+	}
+	return c
+}
+
+// lastByteCorpus returns names of various lengths that differ only in the last byte
+func lastByteCorpus(r *rand.Rand) *corpus {
+	c := &corpus{name: "last-byte"}
+	for _, n := range []int{1, 2, 7, 8, 9, 15, 16, 17, 31, 32, 33, 63, 64, 65, 99, 100} {
+		prefix := strings.Repeat("x", n-1)
+		for _, last := range "abcABC019~" {
+			for range 1 + r.IntN(3) {
+				c.add(prefix+string(last), randomTenths(r))
+			}
+		}
+	}
+	r.Shuffle(len(c.rows), func(i, j int) { c.rows[i], c.rows[j] = c.rows[j], c.rows[i] })
+	return c
+}
+
+const (
+	fnv1aOffset64 = 14695981039346656037
+	fnv1aPrime64  = 1099511628211
+	fnv1aOffset32 = 2166136261
+	fnv1aPrime32  = 16777619
+)
+
+func fnv1a64(s []byte) uint64 {
+	h := uint64(fnv1aOffset64)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnv1aPrime64
+	}
+	return h
+}
+
+func fnv1a32(s []byte) uint32 {
+	h := uint32(fnv1aOffset32)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= fnv1aPrime32
+	}
+	return h
+}
+
+// fnv1aCollisionsCorpus returns names which 64-bit FNV-1a hashes have the same lower 16 bits,
+// i.e. they fall into the same slot of a table of up to 65536 entries indexed by the hash,
+// and pairs of names with the same 32-bit FNV-1a hash.
+func fnv1aCollisionsCorpus(r *rand.Rand) *corpus {
+	c := &corpus{name: "fnv1a-collisions"}
+
+	var names []string
+	var buf []byte
+	for i := int64(0); len(names) < 256; i++ {
+		buf = strconv.AppendInt(append(buf[:0], 's'), i, 36)
+		if fnv1a64(buf)&0xffff == 0 {
+			names = append(names, string(buf))
+		}
+	}
+
+	// birthday search, about 2^16 names give the first collision
+	seen := make(map[uint32]int64)
+	for i := int64(0); len(names) < 256+64; i++ {
+		buf = strconv.AppendInt(append(buf[:0], 'c'), i, 36)
+		h := fnv1a32(buf)
+		if other, ok := seen[h]; ok {
+			names = append(names, "c"+strconv.FormatInt(other, 36), string(buf))
+		}
+		seen[h] = i
+	}
+
+	for range 10 * len(names) {
+		c.add(names[r.IntN(len(names))], randomTenths(r))
+	}
+	return c
+}
+
+// allValuesCorpus returns every temperature from -99.9 to 99.9 for a few stations in random order
+func allValuesCorpus(r *rand.Rand) *corpus {
+	c := &corpus{name: "all-values"}
+	for _, name := range []string{"Min", "Max", "Ä", "Zero"} {
+		for t := int64(-999); t <= 999; t++ {
+			c.add(name, t)
+		}
+	}
+	r.Shuffle(len(c.rows), func(i, j int) { c.rows[i], c.rows[j] = c.rows[j], c.rows[i] })
+	return c
+}
+
+// maxStationsCorpus returns measurements of exactly 10,000 unique stations
+func maxStationsCorpus(r *rand.Rand, stations []station) (*corpus, error) {
+	const maxStations = 10_000
+	if len(stations) < maxStations {
+		return nil, fmt.Errorf("10000 stations corpus needs %d stations, got: %d", maxStations, len(stations))
+	}
+
+	c := &corpus{name: "10000-stations", stations: stations[:maxStations]}
+	for id := range c.stations {
+		c.rows = append(c.rows, measurement{id, randomTenths(r)})
+	}
+	for range 10 * maxStations {
+		id := r.IntN(maxStations)
+		c.rows = append(c.rows, measurement{id, tenths(c.stations[id].mean + 10*r.NormFloat64())})
+	}
+	r.Shuffle(len(c.rows), func(i, j int) { c.rows[i], c.rows[j] = c.rows[j], c.rows[i] })
+	return c, nil
+}
+
+func randomTenths(r *rand.Rand) int64 {
+	return r.Int64N(1999) - 999
+}
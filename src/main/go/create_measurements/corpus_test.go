@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestAdversarialCorpora(t *testing.T) {
+	stations, err := readStations(stationsFile, 10_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corpora, err := adversarialCorpora(stations, 4, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	for _, c := range corpora {
+		if err := c.write(dir); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "measurements-"+c.name+".txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := os.ReadFile(filepath.Join(dir, "measurements-"+c.name+".out"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := checkMeasurements(data); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if string(expected) != exactResults(data) {
+			t.Errorf("%s: wrong expected results", c.name)
+		}
+	}
+
+	if _, err := adversarialCorpora(stations[:9_999], 4, 42); err == nil {
+		t.Errorf("Expected error for less than 10000 stations")
+	}
+}
+
+func TestChunkBoundaryCorpora(t *testing.T) {
+	const lineSize = 107
+
+	for _, workers := range []int{1, 2, 3, 8, 16} {
+		corpora := chunkBoundaryCorpora(rand.New(rand.NewPCG(1, 2)), workers)
+		if len(corpora) != lineSize {
+			t.Fatalf("Expected %d corpora, got: %d", lineSize, len(corpora))
+		}
+
+		for offset, c := range corpora {
+			dir := t.TempDir()
+			if err := c.write(dir); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, "measurements-"+c.name+".txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(data)%workers != 0 {
+				t.Fatalf("%s: size %d is not a multiple of %d", c.name, len(data), workers)
+			}
+			chunkSize := len(data) / workers
+			for k := 1; k < workers; k++ {
+				boundary := k * chunkSize
+				start := bytes.LastIndexByte(data[:boundary], '\n') + 1
+				end := boundary + bytes.IndexByte(data[boundary:], '\n') + 1
+				if boundary-start != offset || end-start != lineSize {
+					t.Errorf("%s: boundary %d is at offset %d of %d bytes line", c.name, boundary, boundary-start, end-start)
+				}
+			}
+		}
+	}
+}
+
+func TestPaddingLines(t *testing.T) {
+	for _, size := range []int{36, 37, 108, 214, 315} {
+		c := &corpus{name: "padding"}
+		paddingLines(c, size)
+
+		n := 0
+		for _, m := range c.rows {
+			name := c.stations[m.id].name
+			if len(name) > 100 {
+				t.Errorf("Padding name longer than 100 bytes: %q", name)
+			}
+			n += len(name) + len(";1.0\n")
+		}
+		if len(c.rows) != 3 || n != size {
+			t.Errorf("Expected 3 lines of %d bytes, got %d lines of %d bytes", size, len(c.rows), n)
+		}
+	}
+}
+
+func TestUTF8NamesCorpus(t *testing.T) {
+	c := utf8NamesCorpus(rand.New(rand.NewPCG(1, 2)))
+	for _, s := range c.stations {
+		if len(s.name) != 100 || !utf8.ValidString(s.name) || utf8.RuneCountInString(s.name) == len(s.name) {
+			t.Errorf("Expected 100 bytes multi-byte name, got %d bytes: %q", len(s.name), s.name)
+		}
+	}
+}
+
+func TestLastByteCorpus(t *testing.T) {
+	c := lastByteCorpus(rand.New(rand.NewPCG(1, 2)))
+	prefixes := make(map[string]int)
+	for _, s := range c.stations {
+		prefixes[s.name[:len(s.name)-1]]++
+	}
+	for prefix, n := range prefixes {
+		if n < 2 {
+			t.Errorf("Expected names differing in the last byte for prefix %q", prefix)
+		}
+	}
+}
+
+func TestFNV1aCollisionsCorpus(t *testing.T) {
+	c := fnv1aCollisionsCorpus(rand.New(rand.NewPCG(1, 2)))
+
+	slots := make(map[uint64]int)
+	hashes := make(map[uint32]int)
+	for _, s := range c.stations {
+		slots[fnv1a64([]byte(s.name))&0xffff]++
+		hashes[fnv1a32([]byte(s.name))]++
+	}
+	if len(slots) > 1+64 {
+		t.Errorf("Expected names colliding in the lower 16 bits, got %d slots", len(slots))
+	}
+	collisions := 0
+	for _, n := range hashes {
+		if n > 1 {
+			collisions++
+		}
+	}
+	if collisions == 0 {
+		t.Errorf("Expected names with the same 32-bit hash")
+	}
+}
+
+func TestFNV1a(t *testing.T) {
+	// test vectors of https://datatracker.ietf.org/doc/html/draft-eastlake-fnv
+	if h := fnv1a64([]byte("foobar")); h != 0x85944171f73967e8 {
+		t.Errorf("Wrong 64-bit hash: %x", h)
+	}
+	if h := fnv1a32([]byte("foobar")); h != 0xbf9cf968 {
+		t.Errorf("Wrong 32-bit hash: %x", h)
+	}
+}
+
+func TestAllValuesCorpus(t *testing.T) {
+	c := allValuesCorpus(rand.New(rand.NewPCG(1, 2)))
+	for id := range c.stations {
+		seen := make(map[int64]bool)
+		for _, m := range c.rows {
+			if m.id == id {
+				seen[m.t] = true
+			}
+		}
+		if len(seen) != 1999 || !seen[-999] || !seen[999] {
+			t.Errorf("Expected all temperatures for %s, got %d", c.stations[id].name, len(seen))
+		}
+	}
+}
+
+func TestMaxStationsCorpus(t *testing.T) {
+	stations, err := readStations(stationsFile, 10_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := maxStationsCorpus(rand.New(rand.NewPCG(1, 2)), stations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range c.rows {
+		seen[c.stations[m.id].name] = true
+	}
+	if len(seen) != 10_000 {
+		t.Errorf("Expected 10000 unique stations, got: %d", len(seen))
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"unicode/utf16"
+)
+
+// stats of station temperatures in tenths of a degree
+type stats struct {
+	min, max, sum, count int64
+}
+
+func (s *stats) add(t int64) {
+	if s.count == 0 {
+		s.min = t
+		s.max = t
+	} else {
+		s.min = min(s.min, t)
+		s.max = max(s.max, t)
+	}
+	s.sum += t
+	s.count++
+}
+
+func (s *stats) merge(other *stats) {
+	if other.count == 0 {
+		return
+	}
+	if s.count == 0 {
+		*s = *other
+		return
+	}
+	s.min = min(s.min, other.min)
+	s.max = max(s.max, other.max)
+	s.sum += other.sum
+	s.count += other.count
+}
+
+// writeExpected writes results of the stations in the format of the reference implementation, i.e.
+// {Abha=-23.0/18.0/59.2, Abidjan=-16.2/26.0/67.3, ...} with stations sorted like Java strings.
+// Results are indexed like stations and stations without measurements are skipped.
+func writeExpected(w io.Writer, stations []station, results []stats) error {
+	var ids []int
+	for i := range results {
+		if results[i].count > 0 {
+			ids = append(ids, i)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return compareJava(stations[ids[i]].name, stations[ids[j]].name) < 0
+	})
+
+	bw := bufio.NewWriter(w)
+	var buf []byte
+	bw.WriteByte('{')
+	for i, id := range ids {
+		if i > 0 {
+			bw.WriteString(", ")
+		}
+		s := &results[id]
+		buf = append(buf[:0], stations[id].name...)
+		buf = append(buf, '=')
+		buf = appendTenths(buf, s.min)
+		buf = append(buf, '/')
+		buf = appendTenths(buf, mean(s.sum, s.count))
+		buf = append(buf, '/')
+		buf = appendTenths(buf, s.max)
+		bw.Write(buf)
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// mean returns the mean of count values summing to sum as Java Math.round
+// does, i.e. halves are rounded up, -1.5 to -1 and 1.5 to 2.
+func mean(sum, count int64) int64 {
+	// Math.round(x) is floor(x + 1/2), here over the common denominator 2*count
+	n, d := 2*sum+count, 2*count
+	q := n / d
+	if n%d != 0 && n < 0 {
+		q--
+	}
+	return q
+}
+
+// compareJava compares strings like Java String.compareTo, i.e. by UTF-16 code units
+// which orders characters beyond the Basic Multilingual Plane before U+E000..U+FFFF unlike UTF-8 bytes.
+func compareJava(a, b string) int {
+	ua, ub := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ua[i] != ub[i] {
+			return int(ua[i]) - int(ub[i])
+		}
+	}
+	return len(ua) - len(ub)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// station is a weather station with the mean temperature in degrees
+type station struct {
+	name string
+	mean float64
+}
+
+// readStations reads up to limit stations with unique names from the file of "<name>;<mean>" lines,
+// it skips lines starting with '#'.
+func readStations(name string, limit int) ([]station, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var stations []station
+	seen := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan() && len(stations) < limit; line++ {
+		text := s.Text()
+		if strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(text, ";")
+		if !ok || name == "" || len(name) > 100 {
+			return nil, fmt.Errorf("%s:%d: invalid station: %q", f.Name(), line, text)
+		}
+		mean, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid mean temperature: %w", f.Name(), line, err)
+		}
+
+		if !seen[name] {
+			seen[name] = true
+			stations = append(stations, station{name, mean})
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(stations) == 0 {
+		return nil, fmt.Errorf("%s: no stations", f.Name())
+	}
+	return stations, nil
+}
+
+// blockRows is the number of rows generated from one random source,
+// it makes the output independent of the number of workers
+const blockRows = 1 << 16
+
+type generator struct {
+	stations []station
+	seed     uint64
+	stddev   float64
+	workers  int
+
+	// expected enables computing results of the generated measurements
+	expected bool
+}
+
+type block struct {
+	index int64
+	rows  int
+	data  chan []byte // receives the generated rows
+}
+
+// generate writes rows of measurements of randomly chosen stations with
+// temperatures normally distributed around the station mean.
+// Workers generate blocks of rows in parallel and the blocks are written in order.
+// If expected is set it returns results of the measurements indexed like stations.
+func (g *generator) generate(w io.Writer, rows int64) ([]stats, error) {
+	workers := max(1, g.workers)
+
+	// jobs for workers and the same blocks in order for the writer,
+	// the capacity bounds the number of blocks in memory
+	jobs := make(chan block, workers)
+	ordered := make(chan block, 2*workers)
+	free := make(chan []byte, 2*workers+1)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(jobs)
+		defer close(ordered)
+		for index := int64(0); index*blockRows < rows; index++ {
+			b := block{index: index, rows: int(min(blockRows, rows-index*blockRows)), data: make(chan []byte, 1)}
+			select {
+			case ordered <- b:
+			case <-done:
+				return
+			}
+			jobs <- b
+		}
+	}()
+
+	var wg sync.WaitGroup
+	results := make([][]stats, workers)
+	for i := range workers {
+		if g.expected {
+			results[i] = make([]stats, len(g.stations))
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range jobs {
+				var buf []byte
+				select {
+				case buf = <-free:
+				default:
+				}
+				b.data <- g.appendBlock(buf[:0], b.index, b.rows, results[i])
+			}
+		}()
+	}
+
+	var err error
+	for b := range ordered {
+		data := <-b.data
+		if err == nil {
+			if _, err = w.Write(data); err != nil {
+				close(done)
+			}
+		}
+		free <- data
+	}
+	wg.Wait()
+
+	if err != nil || !g.expected {
+		return nil, err
+	}
+	for _, r := range results[1:] {
+		for i := range r {
+			results[0][i].merge(&r[i])
+		}
+	}
+	return results[0], nil
+}
+
+// appendBlock appends rows of the block generated by the random source of the block index,
+// it adds the measurements to results unless they are nil.
+func (g *generator) appendBlock(buf []byte, index int64, rows int, results []stats) []byte {
+	r := rand.New(rand.NewPCG(g.seed, uint64(index)))
+	for range rows {
+		id := r.IntN(len(g.stations))
+		s := &g.stations[id]
+		t := tenths(s.mean + g.stddev*r.NormFloat64())
+		buf = append(buf, s.name...)
+		buf = append(buf, ';')
+		buf = appendTenths(buf, t)
+		buf = append(buf, '\n')
+		if results != nil {
+			results[id].add(t)
+		}
+	}
+	return buf
+}
+
+// tenths returns the temperature rounded to tenths of a degree like Java Math.round and limited to ±99.9
+func tenths(temperature float64) int64 {
+	return max(-999, min(999, int64(math.Floor(temperature*10+0.5))))
+}
+
+// appendTenths appends the temperature given in tenths of a degree within ±99.9 with one decimal digit
+func appendTenths(buf []byte, t int64) []byte {
+	if t < 0 {
+		buf = append(buf, '-')
+		t = -t
+	}
+	if t >= 100 {
+		buf = append(buf, byte('0'+t/100))
+	}
+	return append(buf, byte('0'+t/10%10), '.', byte('0'+t%10))
+}
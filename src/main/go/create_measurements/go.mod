@@ -0,0 +1,3 @@
+module 1brc/create_measurements
+
+go 1.22.1
@@ -0,0 +1,115 @@
+// Command create_measurements writes measurements in the 1brc format,
+// i.e. "<station name>;<temperature>" lines, for the stations of data/weather_stations.csv.
+//
+// Usage:
+//
+//	create_measurements [flags] <number of records to create>
+//	create_measurements [flags] -adversarial <directory>
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+	stationsFile := flag.String("stations", "data/weather_stations.csv", "file of station;mean temperature lines, lines starting with # are skipped")
+	maxStations := flag.Int("max-stations", 10_000, "use up to this many unique stations from the stations file")
+	output := flag.String("o", "measurements.txt", "output file")
+	seed := flag.Uint64("seed", uint64(time.Now().UnixNano()), "random seed, the same seed produces the same measurements")
+	stddev := flag.Float64("stddev", 10, "standard deviation of temperatures around the station mean")
+	workers := flag.Int("workers", runtime.NumCPU(), "number of goroutines generating measurements")
+	expected := flag.Bool("expected", false, "also write the expected result of the reference implementation into the output file with .out extension instead of .txt")
+	adversarial := flag.String("adversarial", "", "write adversarial corpora with their expected results into this directory instead of random measurements")
+	chunkWorkers := flag.Int("chunk-workers", 8, "number of chunks the adversarial chunk boundary corpora are split into")
+	flag.Parse()
+
+	if *adversarial != "" {
+		writeAdversarial(*adversarial, *stationsFile, *chunkWorkers, *seed)
+		return
+	}
+
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: create_measurements [flags] <number of records to create>")
+		fmt.Fprintln(os.Stderr, "       create_measurements [flags] -adversarial <directory>")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	rows, err := strconv.ParseInt(flag.Arg(0), 10, 64)
+	if err != nil || rows < 0 {
+		log.Fatalf("Invalid number of records to create: %s", flag.Arg(0))
+	}
+
+	stations, err := readStations(*stationsFile, *maxStations)
+	if err != nil {
+		log.Fatalf("Read stations: %v", err)
+	}
+
+	started := time.Now()
+
+	f, err := os.Create(*output)
+	if err != nil {
+		log.Fatalf("Create: %v", err)
+	}
+	w := bufio.NewWriterSize(f, 1<<20)
+
+	g := generator{stations: stations, seed: *seed, stddev: *stddev, workers: *workers, expected: *expected}
+	results, err := g.generate(w, rows)
+	if err != nil {
+		log.Fatalf("Generate: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("Write: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("Close: %v", err)
+	}
+
+	if *expected {
+		if err := writeExpectedFile(strings.TrimSuffix(*output, ".txt")+".out", stations, results); err != nil {
+			log.Fatalf("Write expected: %v", err)
+		}
+	}
+
+	log.Printf("Created file with %d measurements of %d stations in %d ms (seed %d)", rows, len(stations), time.Since(started).Milliseconds(), *seed)
+}
+
+func writeAdversarial(dir, stationsFile string, chunkWorkers int, seed uint64) {
+	stations, err := readStations(stationsFile, 10_000)
+	if err != nil {
+		log.Fatalf("Read stations: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Fatalf("Create directory: %v", err)
+	}
+
+	corpora, err := adversarialCorpora(stations, chunkWorkers, seed)
+	if err != nil {
+		log.Fatalf("Generate: %v", err)
+	}
+	for _, c := range corpora {
+		if err := c.write(dir); err != nil {
+			log.Fatalf("Write %s: %v", c.name, err)
+		}
+	}
+	log.Printf("Created %d adversarial corpora in %s (seed %d)", len(corpora), dir, seed)
+}
+
+func writeExpectedFile(name string, stations []station, results []stats) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := writeExpected(f, stations, results); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+const stationsFile = "../../../../data/weather_stations.csv"
+
+// checkMeasurements checks that every line of data is a measurement in the 1brc format
+func checkMeasurements(data []byte) error {
+	for i, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+		name, value, ok := bytes.Cut(line, []byte(";"))
+		if !ok || len(name) == 0 || len(name) > 100 {
+			return fmt.Errorf("line %d: invalid station: %q", i+1, line)
+		}
+		t, err := strconv.ParseFloat(string(value), 64)
+		if err != nil || t < -99.9 || t > 99.9 || !bytes.Equal(value, appendTenths(nil, tenths(t))) {
+			return fmt.Errorf("line %d: invalid temperature: %q", i+1, line)
+		}
+	}
+	return nil
+}
+
+func TestReadStations(t *testing.T) {
+	stations, err := readStations(stationsFile, 10_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stations) != 10_000 {
+		t.Errorf("Wrong number of stations, expected: 10000, got: %d", len(stations))
+	}
+	if s := stations[0]; s.name != "Tokyo" || s.mean != 35.6897 {
+		t.Errorf("Wrong first station: %+v", s)
+	}
+
+	seen := make(map[string]bool)
+	for _, s := range stations {
+		if seen[s.name] {
+			t.Errorf("Duplicate station: %s", s.name)
+		}
+		seen[s.name] = true
+	}
+}
+
+func TestReadStationsInvalid(t *testing.T) {
+	for _, data := range []string{"", "# comment\n", "Tokyo\n", "Tokyo;x\n", ";1.0\n"} {
+		name := filepath.Join(t.TempDir(), "stations.csv")
+		if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readStations(name, 10); err == nil {
+			t.Errorf("Expected error for %q", data)
+		}
+	}
+}
+
+func TestTenths(t *testing.T) {
+	for _, tc := range []struct {
+		value    float64
+		expected string
+	}{
+		{value: -150, expected: "-99.9"},
+		{value: -12.35, expected: "-12.3"},
+		{value: -0.05, expected: "0.0"},
+		{value: -0.04, expected: "0.0"},
+		{value: 0, expected: "0.0"},
+		{value: 0.05, expected: "0.1"},
+		{value: 9.96, expected: "10.0"},
+		{value: 150, expected: "99.9"},
+	} {
+		if s := appendTenths(nil, tenths(tc.value)); string(s) != tc.expected {
+			t.Errorf("Wrong tenths of %v, expected: %s, got: %s", tc.value, tc.expected, s)
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	stations, err := readStations(stationsFile, 413)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const rows = 3*blockRows + 123
+	var expected []byte
+	for _, workers := range []int{1, 2, 7} {
+		var out bytes.Buffer
+		g := generator{stations: stations, seed: 42, stddev: 10, workers: workers}
+		if _, err := g.generate(&out, rows); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := bytes.Count(out.Bytes(), []byte("\n")); n != rows {
+			t.Errorf("Wrong number of rows with %d workers, expected: %d, got: %d", workers, rows, n)
+		}
+		if err := checkMeasurements(out.Bytes()); err != nil {
+			t.Errorf("Invalid measurements with %d workers: %v", workers, err)
+		}
+
+		// output does not depend on the number of workers
+		if expected == nil {
+			expected = out.Bytes()
+		} else if !bytes.Equal(out.Bytes(), expected) {
+			t.Errorf("Different output with %d workers", workers)
+		}
+	}
+
+	var out bytes.Buffer
+	g := generator{stations: stations, seed: 43, stddev: 10, workers: 1}
+	if _, err := g.generate(&out, rows); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(out.Bytes(), expected) {
+		t.Errorf("Expected different output for different seed")
+	}
+}
+
+// exactResults computes results of measurements in data with big.Rat
+func exactResults(data []byte) string {
+	type result struct {
+		min, max, sum *big.Rat
+		count         int64
+	}
+	// tenths rounded to the closest integer with ties rounding towards positive infinity
+	round := func(x *big.Rat) string {
+		x = new(big.Rat).Add(new(big.Rat).Mul(x, big.NewRat(10, 1)), big.NewRat(1, 2))
+		t := new(big.Int).Div(x.Num(), x.Denom()).Int64()
+		if t < 0 {
+			return fmt.Sprintf("-%d.%d", -t/10, -t%10)
+		}
+		return fmt.Sprintf("%d.%d", t/10, t%10)
+	}
+
+	results := make(map[string]*result)
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		name, value, _ := strings.Cut(line, ";")
+		t, _ := new(big.Rat).SetString(value)
+		r := results[name]
+		if r == nil {
+			r = &result{min: t, max: t, sum: new(big.Rat)}
+			results[name] = r
+		}
+		if t.Cmp(r.min) < 0 {
+			r.min = t
+		}
+		if t.Cmp(r.max) > 0 {
+			r.max = t
+		}
+		r.sum.Add(r.sum, t)
+		r.count++
+	}
+
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return slices.Compare(utf16.Encode([]rune(names[i])), utf16.Encode([]rune(names[j]))) < 0
+	})
+
+	var out strings.Builder
+	out.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			out.WriteString(", ")
+		}
+		r := results[name]
+		mean := new(big.Rat).Quo(r.sum, big.NewRat(r.count, 1))
+		fmt.Fprintf(&out, "%s=%s/%s/%s", name, round(r.min), round(mean), round(r.max))
+	}
+	out.WriteString("}\n")
+	return out.String()
+}
+
+func TestGenerateExpected(t *testing.T) {
+	stations, err := readStations(stationsFile, 10_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		rows   int64
+		stddev float64
+	}{
+		{rows: 0, stddev: 10},
+		{rows: 1, stddev: 10},
+		{rows: 2*blockRows + 1, stddev: 10},
+		// mostly ties of means
+		{rows: blockRows, stddev: 0.1},
+	} {
+		var out, expected bytes.Buffer
+		g := generator{stations: stations, seed: 42, stddev: tc.stddev, workers: 3, expected: true}
+		results, err := g.generate(&out, tc.rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeExpected(&expected, stations, results); err != nil {
+			t.Fatal(err)
+		}
+
+		reference := "{}\n"
+		if tc.rows > 0 {
+			reference = exactResults(out.Bytes())
+		}
+		if expected.String() != reference {
+			t.Errorf("Wrong expected results of %d rows with stddev %v", tc.rows, tc.stddev)
+		}
+	}
+}
+
+func TestCompareJava(t *testing.T) {
+	for _, tc := range []struct {
+		a, b     string
+		expected int
+	}{
+		{a: "a", b: "a", expected: 0},
+		{a: "a", b: "b", expected: -1},
+		{a: "ab", b: "a", expected: 1},
+		{a: "Ä", b: "Z", expected: 1},
+		// U+1D538 is encoded as surrogates D835 DD38 that are less than U+FFFD unlike UTF-8 bytes
+		{a: "\U0001D538", b: "\uFFFD", expected: -1},
+	} {
+		if c := compareJava(tc.a, tc.b); (c > 0) != (tc.expected > 0) || (c < 0) != (tc.expected < 0) {
+			t.Errorf("Wrong comparison of %q and %q, expected: %d, got: %d", tc.a, tc.b, tc.expected, c)
+		}
+	}
+}
+
+type failingWriter struct{ n int }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n == 0 {
+		return 0, fmt.Errorf("disk full")
+	}
+	w.n--
+	return len(p), nil
+}
+
+func TestGenerateWriteError(t *testing.T) {
+	stations, err := readStations(stationsFile, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := generator{stations: stations, seed: 42, stddev: 10, workers: 4}
+	if _, err := g.generate(&failingWriter{n: 2}, 100*blockRows); err == nil || err.Error() != "disk full" {
+		t.Errorf("Expected write error, got: %v", err)
+	}
+}
+
+func BenchmarkGenerate(b *testing.B) {
+	stations, err := readStations(stationsFile, 10_000)
+	if err != nil {
+		b.Fatal(err)
+	}
+	g := generator{stations: stations, seed: 42, stddev: 10}
+
+	const rows = 1 << 20
+	buf := g.appendBlock(nil, 0, rows, nil)
+	b.SetBytes(int64(len(buf)))
+	b.ReportMetric(rows, "rows/op")
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		buf = g.appendBlock(buf[:0], int64(i), rows, nil)
+	}
+}
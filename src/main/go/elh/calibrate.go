@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"time"
+)
+
+// Calibration with CALIBRATE=true parses a sample of the input with a grid of
+// parser counts and chunk sizes and saves the fastest settings to the config
+// file that later runs pick up.
+
+const (
+	defaultCalibrateSampleMB = 1024
+	configFileName           = "1brc-elh.json"
+
+	// runs of each setting, the fastest counts
+	calibrateRuns = 3
+)
+
+var calibrateChunkSizesMB = []int{1, 4, 16, 64, 256}
+
+type config struct {
+	NumParsers       int `json:"num_parsers"`
+	ParseChunkSizeMB int `json:"parse_chunk_size_mb"`
+}
+
+// configPath returns the config file or "" if there is no user config dir
+func configPath() string {
+	if path := os.Getenv("CONFIG_PATH"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, configFileName)
+}
+
+// load overrides settings with the ones of the config file if it exists
+func (c *config) load(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+
+	var loaded config
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	if loaded.NumParsers < 1 || loaded.ParseChunkSizeMB < 1 {
+		return fmt.Errorf("invalid config %s: %s", path, bytes.TrimSpace(data))
+	}
+	*c = loaded
+	return nil
+}
+
+func (c config) save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	return nil
+}
+
+// calibrateGrid returns settings to measure: parser counts doubling up to twice
+// numCPU and chunk sizes that split the sample into more than one chunk, or the
+// smallest one. Settings with more parsers than chunks of the sample are
+// skipped as every parser allocates a chunk sized buffer.
+func calibrateGrid(sampleSize int64, numCPU int) []config {
+	var parserCounts []int
+	for n := 1; n <= 2*numCPU; n *= 2 {
+		parserCounts = append(parserCounts, n)
+	}
+	if !slices.Contains(parserCounts, numCPU) {
+		parserCounts = append(parserCounts, numCPU)
+		slices.Sort(parserCounts)
+	}
+
+	var grid []config
+	for _, numParsers := range parserCounts {
+		for i, chunkSizeMB := range calibrateChunkSizesMB {
+			chunkSize := int64(chunkSizeMB) * mb
+			if i > 0 && chunkSize >= sampleSize {
+				break
+			}
+			if chunks := (sampleSize + chunkSize - 1) / chunkSize; int64(numParsers) > chunks {
+				continue
+			}
+			grid = append(grid, config{NumParsers: numParsers, ParseChunkSizeMB: chunkSizeMB})
+		}
+	}
+	return grid
+}
+
+// calibrate parses the first sampleSize bytes of the file with every setting
+// of the grid and returns the one with the highest throughput.
+func calibrate(f *os.File, sampleSize int64) (config, error) {
+	if sampleSize == 0 {
+		return config{}, errors.New("failed to calibrate: empty input")
+	}
+
+	// warm up the page cache, with no more parsers than chunks
+	warmUpParsers := int(min(int64(runtime.NumCPU()), (sampleSize+defaultParseChunkSizeMB*mb-1)/(defaultParseChunkSizeMB*mb)))
+	if _, err := parseFile(f, sampleSize, warmUpParsers, defaultParseChunkSizeMB*mb); err != nil {
+		return config{}, err
+	}
+
+	var best config
+	var bestElapsed time.Duration
+	for _, c := range calibrateGrid(sampleSize, runtime.NumCPU()) {
+		elapsed := time.Duration(1<<63 - 1)
+		for i := 0; i < calibrateRuns; i++ {
+			start := time.Now()
+			if _, err := parseFile(f, sampleSize, c.NumParsers, c.ParseChunkSizeMB*mb); err != nil {
+				return config{}, err
+			}
+			elapsed = min(elapsed, time.Since(start))
+		}
+		log.Printf("NUM_PARSERS=%d PARSE_CHUNK_SIZE_MB=%d: %.0f MB/s",
+			c.NumParsers, c.ParseChunkSizeMB, float64(sampleSize)/mb/elapsed.Seconds())
+
+		if best.NumParsers == 0 || elapsed < bestElapsed {
+			best, bestElapsed = c, elapsed
+		}
+	}
+	return best, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCalibrateGrid(t *testing.T) {
+	for _, tc := range []struct {
+		sampleSize int64
+		numCPU     int
+	}{
+		{sampleSize: 1024 * mb, numCPU: 16},
+		{sampleSize: 1024 * mb, numCPU: 6},
+		{sampleSize: 10 * mb, numCPU: 16},
+		{sampleSize: 2 * mb, numCPU: 4},
+	} {
+		grid := calibrateGrid(tc.sampleSize, tc.numCPU)
+		if len(grid) == 0 {
+			t.Fatalf("Empty grid for sample of %d bytes", tc.sampleSize)
+		}
+
+		hasNumCPU := false
+		for _, c := range grid {
+			chunkSize := int64(c.ParseChunkSizeMB) * mb
+			// every parser has a chunk of the sample to parse, so parser buffers are
+			// less than the sample and one more chunk
+			if c.NumParsers > 2*tc.numCPU || int64(c.NumParsers)*chunkSize >= tc.sampleSize+chunkSize {
+				t.Errorf("Too many parsers for sample of %d bytes and %d CPUs: %+v", tc.sampleSize, tc.numCPU, c)
+			}
+			if c.ParseChunkSizeMB != calibrateChunkSizesMB[0] && chunkSize >= tc.sampleSize {
+				t.Errorf("Chunk size not smaller than sample of %d bytes: %+v", tc.sampleSize, c)
+			}
+			hasNumCPU = hasNumCPU || c.NumParsers == tc.numCPU
+		}
+		if !hasNumCPU && int64(tc.numCPU) <= tc.sampleSize/mb {
+			t.Errorf("Expected %d parsers in the grid for sample of %d bytes: %+v", tc.numCPU, tc.sampleSize, grid)
+		}
+	}
+
+	if grid := calibrateGrid(mb/2, 4); len(grid) != 1 || grid[0] != (config{NumParsers: 1, ParseChunkSizeMB: 1}) {
+		t.Errorf("Expected a single parser of 1 MB chunks for sample of 0.5 MB, got: %+v", grid)
+	}
+}
+
+func TestConfigLoad(t *testing.T) {
+	dir := t.TempDir()
+	defaults := config{NumParsers: 3, ParseChunkSizeMB: 5}
+
+	for _, tc := range []struct {
+		name     string
+		data     string // no file if empty
+		expected config
+		err      bool
+	}{
+		{name: "missing", expected: defaults},
+		{name: "valid", data: `{"num_parsers": 8, "parse_chunk_size_mb": 16}`, expected: config{NumParsers: 8, ParseChunkSizeMB: 16}},
+		{name: "invalid json", data: `{"num_parsers": 8,`, err: true},
+		{name: "invalid values", data: `{"num_parsers": 0, "parse_chunk_size_mb": 16}`, err: true},
+		{name: "missing values", data: `{}`, err: true},
+	} {
+		path := filepath.Join(dir, tc.name+".json")
+		if tc.data != "" {
+			if err := os.WriteFile(path, []byte(tc.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		cfg := defaults
+		err := cfg.load(path)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if cfg != tc.expected {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.expected, cfg)
+		}
+	}
+
+	// no user config dir
+	cfg := defaults
+	if err := cfg.load(""); err != nil || cfg != defaults {
+		t.Errorf("Expected defaults without config path, got %+v: %v", cfg, err)
+	}
+}
+
+func TestConfigSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dir", "config.json")
+	saved := config{NumParsers: 4, ParseChunkSizeMB: 16}
+	if err := saved.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	var loaded config
+	if err := loaded.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if loaded != saved {
+		t.Errorf("Expected %+v, got %+v", saved, loaded)
+	}
+}
+
+func TestSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	missing := filepath.Join(t.TempDir(), "missing.json")
+	if err := (config{NumParsers: 4, ParseChunkSizeMB: 16}).save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name                         string
+		cfgPath, numParsers, chunkMB string
+		expected                     config
+	}{
+		{name: "defaults", cfgPath: missing, expected: config{NumParsers: runtime.NumCPU(), ParseChunkSizeMB: defaultParseChunkSizeMB}},
+		{name: "config", cfgPath: path, expected: config{NumParsers: 4, ParseChunkSizeMB: 16}},
+		{name: "env over config", cfgPath: path, numParsers: "2", chunkMB: "1", expected: config{NumParsers: 2, ParseChunkSizeMB: 1}},
+		{name: "env over default", cfgPath: missing, numParsers: "2", expected: config{NumParsers: 2, ParseChunkSizeMB: defaultParseChunkSizeMB}},
+		{name: "env and config", cfgPath: path, chunkMB: "1", expected: config{NumParsers: 4, ParseChunkSizeMB: 1}},
+	} {
+		t.Setenv("NUM_PARSERS", tc.numParsers)
+		t.Setenv("PARSE_CHUNK_SIZE_MB", tc.chunkMB)
+
+		cfg, err := settings(tc.cfgPath)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if cfg != tc.expected {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.expected, cfg)
+		}
+	}
+
+	t.Setenv("NUM_PARSERS", "x")
+	if _, err := settings(path); err == nil {
+		t.Errorf("Expected error for invalid NUM_PARSERS")
+	}
+}
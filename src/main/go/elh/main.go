@@ -2,17 +2,17 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math"
 	"os"
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
 	"sort"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 	"unsafe"
@@ -23,10 +23,18 @@ import (
 //
 // Environment variables:
 // - NUM_PARSERS:         number of parsers to run concurrently. if unset, defaults
-//   			          to runtime.NumCPU()
+//   			          to the calibrated config or runtime.NumCPU()
 // - PARSE_CHUNK_SIZE_MB: size of each chunk to parse. if unset, defaults to
-//                        defaultParseChunkSize
+//                        the calibrated config or defaultParseChunkSize
 // - PROFILE:             if "true", enables profiling
+// - CALIBRATE:           if "true", measures throughput of parsing a sample of
+//                        the input with a grid of NUM_PARSERS and
+//                        PARSE_CHUNK_SIZE_MB and saves the fastest to the
+//                        config instead of printing results
+// - CALIBRATE_SAMPLE_MB: size of the input sample to calibrate with. if unset,
+//                        defaults to defaultCalibrateSampleMB
+// - CONFIG_PATH:         calibrated config file. if unset, defaults to
+//                        1brc-elh.json in the user config dir, e.g. ~/.config
 
 var (
 	// others: "heap", "threadcreate", "block", "mutex"
@@ -43,46 +51,85 @@ const (
 	mb                      = 1024 * 1024 // bytes
 )
 
+// Stats of temperatures in tenths of a degree, integers keep the sum exact
 type Stats struct {
-	Min, Max, Sum float64
-	Count         int
+	Min, Max, Sum int64
+	Count         int64
 }
 
-// rounding floats to 1 decimal place with 0.05 rounding up to 0.1
-func round(x float64) float64 {
-	return math.Floor((x+0.05)*10) / 10
+// mean returns the average in tenths like the reference implementation, which
+// rounds halves up, e.g. -0.05 to 0.0 and 0.05 to 0.1.
+func (s *Stats) mean() int64 {
+	// the quotient is truncated towards zero, the remainder decides rounding: a
+	// positive mean rounds up from half, a negative one rounds down past half
+	q, r := s.Sum/s.Count, s.Sum%s.Count
+	if r >= 0 && 2*r >= s.Count {
+		q++
+	} else if r < 0 && -2*r > s.Count {
+		q--
+	}
+	return q
 }
 
-// parseFloatFast is a high performance float parser using the assumption that
-// the byte slice will always have a single decimal digit.
-func parseFloatFast(bs []byte) float64 {
+// parseTenthsFast is a high performance number parser using the assumption
+// that the byte slice will always have a single decimal digit. It returns the
+// value in tenths.
+func parseTenthsFast(bs []byte) int64 {
 	var intStartIdx int // is negative?
 	if bs[0] == '-' {
 		intStartIdx = 1
 	}
 
-	v := float64(bs[len(bs)-1]-'0') / 10 // single decimal digit
-	place := 1.0
+	v := int64(bs[len(bs)-1] - '0') // single decimal digit
+	place := int64(10)
 	for i := len(bs) - 3; i >= intStartIdx; i-- { // integer part
-		v += float64(bs[i]-'0') * place
+		v += int64(bs[i]-'0') * place
 		place *= 10
 	}
 
 	if intStartIdx == 1 {
-		v *= -1
+		v = -v
 	}
 	return v
 }
 
+// appendTenths appends the value in tenths with a single decimal digit
+func appendTenths(b []byte, v int64) []byte {
+	if v < 0 {
+		b = append(b, '-')
+		v = -v
+	}
+	b = strconv.AppendInt(b, v/10, 10)
+	return append(b, '.', byte('0'+v%10))
+}
+
+// parserResult is the stats of all chunks parsed by a parser or the error
+// parsing a chunk
+type parserResult struct {
+	stats map[string]*Stats
+	err   error
+}
+
 // size is the intended number of bytes to parse. buffer should be longer than size
 // because we need to continue reading until the end of the line in order to
-// properly segment the entire file and not miss any data.
-func parseAt(f *os.File, buf []byte, offset int64, size int) map[string]*Stats {
-	stats := make(map[string]*Stats, maxNameNum)
-	n, err := f.ReadAt(buf, offset) // load the buffer
+// properly segment the entire file and not miss any data. Stats of the chunk
+// are added to stats so that a parser keeps one aggregate across chunks.
+//
+// The chunk parses lines starting within [offset, offset+size). Reading starts
+// one byte before offset so that a line starting exactly at offset is not
+// mistaken for the tail of the previous line. A line crossing the end of the
+// buffer is completed by reading the rest of it from the file.
+func parseAt(f *os.File, buf []byte, offset int64, size int, stats map[string]*Stats) error {
+	readOffset, end := offset, size
+	if offset != 0 {
+		readOffset--
+		end++
+	}
+	n, err := f.ReadAt(buf, readOffset) // load the buffer
 	if err != nil && err != io.EOF {
-		log.Fatal(err)
+		return fmt.Errorf("failed to read chunk at offset %d: %w", offset, err)
 	}
+	atEOF := err == io.EOF
 
 	lastName := make([]byte, maxNameLen) // last name parsed
 	var lastNameLen int
@@ -99,6 +146,10 @@ func parseAt(f *os.File, buf []byte, offset int64, size int) map[string]*Stats {
 			}
 			idx++
 		}
+		// no line starts within the chunk
+		if idx >= end {
+			return nil
+		}
 	}
 	// tick tock between parsing names and values while accummulating stats
 	for {
@@ -106,6 +157,9 @@ func parseAt(f *os.File, buf []byte, offset int64, size int) map[string]*Stats {
 			for idx < n {
 				if buf[idx] == ';' {
 					nameBs := buf[start:idx]
+					if len(nameBs) > len(lastName) {
+						lastName = make([]byte, len(nameBs))
+					}
 					lastNameLen = copy(lastName, nameBs)
 
 					idx++
@@ -119,7 +173,7 @@ func parseAt(f *os.File, buf []byte, offset int64, size int) map[string]*Stats {
 			for idx < n {
 				if buf[idx] == '\n' {
 					valueBs := buf[start:idx]
-					value := parseFloatFast(valueBs)
+					value := parseTenthsFast(valueBs)
 
 					nameUnsafe := unsafe.String(&lastName[0], lastNameLen)
 					if s, ok := stats[nameUnsafe]; !ok {
@@ -144,17 +198,48 @@ func parseAt(f *os.File, buf []byte, offset int64, size int) map[string]*Stats {
 				idx++
 			}
 		}
+		// the last line continues past the end of the buffer, so
+		// continue parsing on a copy extended with the rest of the line
+		if idx >= n && !atEOF && !(isScanningName && start == n) {
+			rest, eof, err := readLineRest(f, readOffset+int64(n))
+			if err != nil {
+				return fmt.Errorf("failed to read chunk at offset %d: %w", offset, err)
+			}
+			buf = append(buf[:n:n], rest...)
+			n = len(buf)
+			atEOF = eof
+			continue
+		}
 		// terminate when we hit the first newline after the intended size OR
-		// when we hit the end of the file
-		if (isScanningName && idx >= size) || idx >= n {
+		// when we hit the end of the buffer
+		if (isScanningName && idx >= end) || idx >= n {
 			break
 		}
 	}
 
-	return stats
+	return nil
 }
 
-func printResults(stats map[string]*Stats) { // doesn't help
+// readLineRest reads from offset through the next new line. eof reports
+// whether the end of the file was reached before a new line.
+func readLineRest(f *os.File, offset int64) (line []byte, eof bool, err error) {
+	piece := make([]byte, 128)
+	for {
+		n, err := f.ReadAt(piece, offset)
+		if i := bytes.IndexByte(piece[:n], '\n'); i != -1 {
+			return append(line, piece[:i+1]...), false, nil
+		}
+		line = append(line, piece[:n]...)
+		offset += int64(n)
+		if err == io.EOF {
+			return line, true, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+func printResults(w io.Writer, stats map[string]*Stats) error {
 	// sorted alphabetically for output
 	names := make([]string, 0, len(stats))
 	for name := range stats {
@@ -162,52 +247,76 @@ func printResults(stats map[string]*Stats) { // doesn't help
 	}
 	sort.Strings(names)
 
-	var builder strings.Builder
+	writer := bufio.NewWriter(w)
+	var b []byte
+	writer.WriteByte('{')
 	for i, name := range names {
 		s := stats[name]
-		// gotcha: first round the sum to to remove float precision errors!
-		avg := round(round(s.Sum) / float64(s.Count))
-		builder.WriteString(fmt.Sprintf("%s=%.1f/%.1f/%.1f", name, s.Min, avg, s.Max))
+		b = append(b[:0], name...)
+		b = append(b, '=')
+		b = appendTenths(b, s.Min)
+		b = append(b, '/')
+		b = appendTenths(b, s.mean())
+		b = append(b, '/')
+		b = appendTenths(b, s.Max)
 		if i < len(names)-1 {
-			builder.WriteString(", ")
+			b = append(b, ", "...)
 		}
+		writer.Write(b)
 	}
-
-	writer := bufio.NewWriter(os.Stdout)
-	fmt.Fprintf(writer, "{%s}\n", builder.String())
-	writer.Flush()
+	writer.WriteString("}\n")
+	return writer.Flush()
 }
 
-// Read file in chunks and parse concurrently. N parsers work off of a chunk
-// offset chan and send results on an output chan. The results are merged into a
-// single map of stats and printed.
 func main() {
-	// parse env vars and inputs
-	shouldProfile := os.Getenv("PROFILE") == "true"
+	if err := run(); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+}
+
+// settings returns NUM_PARSERS and PARSE_CHUNK_SIZE_MB from env vars, the
+// calibrated config file at cfgPath or defaults, in that order of precedence.
+func settings(cfgPath string) (config, error) {
+	cfg := config{NumParsers: runtime.NumCPU(), ParseChunkSizeMB: defaultParseChunkSizeMB}
+	if err := cfg.load(cfgPath); err != nil {
+		return config{}, err
+	}
+
 	var err error
-	var numParsers int
-	{
-		if os.Getenv("NUM_PARSERS") != "" {
-			numParsers, err = strconv.Atoi(os.Getenv("NUM_PARSERS"))
-			if err != nil {
-				log.Fatal(fmt.Errorf("failed to parse NUM_PARSERS: %w", err))
-			}
-		} else {
-			numParsers = runtime.NumCPU()
+	if os.Getenv("NUM_PARSERS") != "" {
+		cfg.NumParsers, err = strconv.Atoi(os.Getenv("NUM_PARSERS"))
+		if err != nil {
+			return config{}, fmt.Errorf("failed to parse NUM_PARSERS: %w", err)
 		}
 	}
-	var parseChunkSize int
-	{
-		if os.Getenv("PARSE_CHUNK_SIZE_MB") != "" {
-			parseChunkSizeMB, err := strconv.Atoi(os.Getenv("PARSE_CHUNK_SIZE_MB"))
-			if err != nil {
-				log.Fatal(fmt.Errorf("failed to parse PARSE_CHUNK_SIZE_MB: %w", err))
-			}
-			parseChunkSize = parseChunkSizeMB * mb
-		} else {
-			parseChunkSize = defaultParseChunkSizeMB * mb
+	if os.Getenv("PARSE_CHUNK_SIZE_MB") != "" {
+		cfg.ParseChunkSizeMB, err = strconv.Atoi(os.Getenv("PARSE_CHUNK_SIZE_MB"))
+		if err != nil {
+			return config{}, fmt.Errorf("failed to parse PARSE_CHUNK_SIZE_MB: %w", err)
 		}
 	}
+	return cfg, nil
+}
+
+// run parses the measurements file and prints the results. It returns instead
+// of exiting on errors so that deferred profiles are written.
+func run() error {
+	// parse env vars and inputs
+	shouldProfile := os.Getenv("PROFILE") == "true"
+	shouldCalibrate := os.Getenv("CALIBRATE") == "true"
+	cfgPath := configPath()
+	if shouldCalibrate && cfgPath == "" {
+		return errors.New("failed to find user config dir to save calibration, set CONFIG_PATH")
+	}
+	var cfg config
+	if !shouldCalibrate {
+		var err error
+		if cfg, err = settings(cfgPath); err != nil {
+			return err
+		}
+	}
+	numParsers, parseChunkSize := cfg.NumParsers, cfg.ParseChunkSizeMB*mb
 
 	measurementsPath := defaultMeasurementsPath
 	if len(os.Args) > 1 {
@@ -235,41 +344,90 @@ func main() {
 	// read file
 	f, err := os.Open(measurementsPath)
 	if err != nil {
-		log.Fatal(fmt.Errorf("failed to open %s file: %w", measurementsPath, err))
+		return fmt.Errorf("failed to open %s file: %w", measurementsPath, err)
 	}
 	defer f.Close()
 
 	info, err := f.Stat()
 	if err != nil {
-		log.Fatal(fmt.Errorf("failed to read %s file: %w", measurementsPath, err))
+		return fmt.Errorf("failed to read %s file: %w", measurementsPath, err)
+	}
+
+	if shouldCalibrate {
+		sampleSize := int64(defaultCalibrateSampleMB * mb)
+		if os.Getenv("CALIBRATE_SAMPLE_MB") != "" {
+			sampleMB, err := strconv.Atoi(os.Getenv("CALIBRATE_SAMPLE_MB"))
+			if err != nil {
+				return fmt.Errorf("failed to parse CALIBRATE_SAMPLE_MB: %w", err)
+			}
+			sampleSize = int64(sampleMB) * mb
+		}
+		best, err := calibrate(f, min(sampleSize, info.Size()))
+		if err != nil {
+			return err
+		}
+		if err := best.save(cfgPath); err != nil {
+			return err
+		}
+		log.Printf("saved NUM_PARSERS=%d PARSE_CHUNK_SIZE_MB=%d to %s", best.NumParsers, best.ParseChunkSizeMB, cfgPath)
+		return nil
+	}
+
+	mergedStats, err := parseFile(f, info.Size(), numParsers, parseChunkSize)
+	if err != nil {
+		return err
 	}
 
+	return printResults(os.Stdout, mergedStats)
+}
+
+// Read the first size bytes of the file in chunks and parse concurrently. N
+// parsers work off of a chunk offset chan and send results on an output chan.
+// The results are merged into a single map of stats.
+func parseFile(f *os.File, size int64, numParsers, parseChunkSize int) (map[string]*Stats, error) {
 	// kick off "parser" workers
 	wg := sync.WaitGroup{}
 	wg.Add(numParsers)
 
 	// buffered to not block on merging
 	chunkOffsetCh := make(chan int64, numParsers)
-	chunkStatsCh := make(chan map[string]*Stats, numParsers)
+	chunkStatsCh := make(chan parserResult, numParsers)
+	// closed on the first error to stop producing and parsing chunks
+	done := make(chan struct{})
 
 	go func() {
+		defer close(chunkOffsetCh)
 		i := 0
-		for i < int(info.Size()) {
-			chunkOffsetCh <- int64(i)
+		for i < int(size) {
+			select {
+			case chunkOffsetCh <- int64(i):
+			case <-done:
+				return
+			}
 			i += parseChunkSize
 		}
-		close(chunkOffsetCh)
 	}()
 
 	for i := 0; i < numParsers; i++ {
-		// WARN: w/ extra padding for line overflow. Each chunk should be read past
-		// the intended size to the next new line. 128 bytes should be enough for
-		// a max 100 byte name + the float value.
+		// w/ extra padding for line overflow. Each chunk should be read past
+		// the intended size to the next new line. 128 bytes are enough for
+		// a max 100 byte name + the float value, parseAt reads the rest of
+		// longer lines separately.
 		buf := make([]byte, parseChunkSize+128)
 		go func() {
+			// aggregate of all chunks parsed by this parser, sent once at the end
+			stats := make(map[string]*Stats, maxNameNum)
 			for chunkOffset := range chunkOffsetCh {
-				chunkStatsCh <- parseAt(f, buf, chunkOffset, parseChunkSize)
+				select {
+				case <-done: // drain remaining offsets
+					continue
+				default:
+				}
+				if err := parseAt(f, buf, chunkOffset, parseChunkSize, stats); err != nil {
+					chunkStatsCh <- parserResult{err: err}
+				}
 			}
+			chunkStatsCh <- parserResult{stats: stats}
 			wg.Done()
 		}()
 	}
@@ -279,9 +437,21 @@ func main() {
 		close(chunkStatsCh)
 	}()
 
+	// keep receiving after an error until parsers stop
+	var parseErr error
 	mergedStats := make(map[string]*Stats, maxNameNum)
-	for chunkStats := range chunkStatsCh {
-		for name, s := range chunkStats {
+	for result := range chunkStatsCh {
+		if result.err != nil {
+			if parseErr == nil {
+				parseErr = result.err
+				close(done)
+			}
+			continue
+		}
+		if parseErr != nil {
+			continue
+		}
+		for name, s := range result.stats {
 			if ms, ok := mergedStats[name]; !ok {
 				mergedStats[name] = s
 			} else {
@@ -297,5 +467,9 @@ func main() {
 		}
 	}
 
-	printResults(mergedStats)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+
+	return mergedStats, nil
 }
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFileReadError(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "measurements.txt")
+	if err := os.WriteFile(name, []byte(strings.Repeat("a;1.0\n", 10_000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close() // every ReadAt fails
+
+	// 600 chunks for 2 parsers
+	done := make(chan error, 1)
+	go func() {
+		_, err := parseFile(f, 60_000, 2, 100)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil || !regexp.MustCompile(`failed to read chunk at offset \d+: `).MatchString(err.Error()) {
+			t.Errorf("Expected error naming the chunk offset, got: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("parseFile did not return after a read error")
+	}
+}
+
+func TestMainReadError(t *testing.T) {
+	if path := os.Getenv("ELH_TEST_MAIN_INPUT"); path != "" {
+		os.Args = []string{os.Args[0], path}
+		main()
+		return
+	}
+
+	// reading a directory fails after it is opened
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMainReadError$")
+	cmd.Env = append(os.Environ(),
+		"ELH_TEST_MAIN_INPUT="+t.TempDir(),
+		"CONFIG_PATH="+filepath.Join(t.TempDir(), "config.json"))
+	out, err := cmd.CombinedOutput()
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Errorf("Expected exit code 1, got: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "failed to read chunk at offset 0") {
+		t.Errorf("Expected the failing offset in the output:\n%s", out)
+	}
+}
+
+// writeMeasurements writes data into a temporary file and returns its name
+func writeMeasurements(t *testing.T, data string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "measurements.txt")
+	if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// parse parses the file with parsers and chunk size in bytes
+func parse(t *testing.T, name string, numParsers, parseChunkSize int) map[string]*Stats {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := parseFile(f, info.Size(), numParsers, parseChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+// expectedStats computes stats of measurements in data line by line
+func expectedStats(data string) map[string]*Stats {
+	stats := make(map[string]*Stats)
+	for _, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+		name, value, _ := strings.Cut(line, ";")
+		f, _ := strconv.ParseFloat(value, 64)
+		v := int64(math.Round(f * 10))
+		s := stats[name]
+		if s == nil {
+			s = &Stats{Min: v, Max: v}
+			stats[name] = s
+		}
+		s.Min = min(s.Min, v)
+		s.Max = max(s.Max, v)
+		s.Sum += v
+		s.Count++
+	}
+	return stats
+}
+
+func TestLongLines(t *testing.T) {
+	// names longer than the 128 bytes padding cross the end of parse buffers
+	r := rand.New(rand.NewSource(1))
+	var data strings.Builder
+	for i := 0; i < 50; i++ {
+		name := strings.Repeat(string(rune('a'+r.Intn(5))), 129+r.Intn(472))
+		fmt.Fprintf(&data, "%s;%d.%d\n", name, r.Intn(199)-99, 5*r.Intn(2))
+	}
+	name := writeMeasurements(t, data.String())
+
+	expected := expectedStats(data.String())
+	for _, chunkSize := range []int{7, 64, 128, 300, 1000} {
+		for _, numParsers := range []int{1, 3} {
+			if got := parse(t, name, numParsers, chunkSize); !reflect.DeepEqual(got, expected) {
+				t.Errorf("Wrong stats with %d parsers and chunk size %d", numParsers, chunkSize)
+			}
+		}
+	}
+}
+
+func TestLinesAtChunkOffsets(t *testing.T) {
+	// 6 bytes lines start exactly at every chunk offset
+	data := "a;1.0\nb;2.0\nc;3.0\nd;4.0\na;5.0\nb;6.0\n"
+	name := writeMeasurements(t, data)
+
+	expected := expectedStats(data)
+	for _, chunkSize := range []int{6, 12, 18} {
+		if got := parse(t, name, 2, chunkSize); !reflect.DeepEqual(got, expected) {
+			t.Errorf("Wrong stats with chunk size %d: %v", chunkSize, got)
+		}
+	}
+}
+
+func TestParseFileAllocs(t *testing.T) {
+	// 10 stations in 1000 lines
+	var data strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&data, "s%d;%d.0\n", i%10, i%100)
+	}
+	name := writeMeasurements(t, data.String())
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	allocs := func(parseChunkSize int) float64 {
+		return testing.AllocsPerRun(10, func() {
+			if _, err := parseFile(f, int64(data.Len()), 2, parseChunkSize); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	// stats maps and Stats of stations are allocated once per parser, parsing
+	// a chunk used to allocate a map sized for maxNameNum and 10 Stats
+	one, many := allocs(data.Len()), allocs(data.Len()/100)
+	if many-one >= 100 {
+		t.Errorf("Expected less than one allocation per chunk, got %.0f for one chunk and %.0f for 100 chunks", one, many)
+	}
+}
+
+func TestParseTenthsFast(t *testing.T) {
+	for v := int64(-999); v <= 999; v++ {
+		s := appendTenths(nil, v)
+		if got := parseTenthsFast(s); got != v {
+			t.Errorf("parseTenthsFast(%q) = %d, expected: %d", s, got, v)
+		}
+	}
+}
+
+func TestMean(t *testing.T) {
+	for _, tc := range []struct {
+		sum, count int64
+		expected   string
+	}{
+		{sum: 0, count: 1, expected: "0.0"},
+		{sum: 1, count: 2, expected: "0.1"},   // 0.05
+		{sum: -1, count: 2, expected: "0.0"},  // -0.05
+		{sum: -3, count: 2, expected: "-0.1"}, // -0.15
+		{sum: -5, count: 3, expected: "-0.2"}, // -0.1666
+		{sum: 255, count: 10, expected: "2.6"},
+		{sum: -255, count: 10, expected: "-2.5"},
+		{sum: -999, count: 1, expected: "-99.9"},
+	} {
+		s := Stats{Sum: tc.sum, Count: tc.count}
+		if got := string(appendTenths(nil, s.mean())); got != tc.expected {
+			t.Errorf("mean of %d/%d = %s, expected: %s", tc.sum, tc.count, got, tc.expected)
+		}
+	}
+}
+
+// results parses the file with parsers and chunk size in bytes and returns the
+// printed results
+func results(t *testing.T, name string, numParsers, parseChunkSize int) string {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := parseFile(f, info.Size(), numParsers, parseChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := printResults(&out, stats); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestRoundingSample(t *testing.T) {
+	const name = "../../../test/resources/samples/measurements-rounding"
+	expected, err := os.ReadFile(name + ".out")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, chunkSize := range []int{100, 4096, mb} {
+		if got := results(t, name+".txt", 3, chunkSize); got != string(expected) {
+			t.Errorf("Wrong results with chunk size %d:\n%s\nexpected:\n%s", chunkSize, got, expected)
+		}
+	}
+}
+
+// ratStats are Stats of exact temperatures in degrees
+type ratStats struct {
+	Min, Max, Sum big.Rat
+	Count         int64
+}
+
+// exactResults is what printResults should print for data, computed from the
+// text of the measurements without parseTenthsFast, mean or appendTenths.
+func exactResults(data string) string {
+	stats := make(map[string]*ratStats)
+	for _, line := range strings.SplitAfter(data, "\n") {
+		if line == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(strings.TrimSuffix(line, "\n"), ";")
+		v, _ := new(big.Rat).SetString(value)
+		s := stats[name]
+		if s == nil {
+			s = &ratStats{}
+			stats[name] = s
+		}
+		if s.Count == 0 || v.Cmp(&s.Min) < 0 {
+			s.Min.Set(v)
+		}
+		if s.Count == 0 || v.Cmp(&s.Max) > 0 {
+			s.Max.Set(v)
+		}
+		s.Sum.Add(&s.Sum, v)
+		s.Count++
+	}
+
+	// Java Math.round of tenths is floor(10*x + 1/2), big.Int Div floors as the
+	// denominator is positive, then FloatString(1) of whole tenths is exact
+	format := func(x *big.Rat) string {
+		x = new(big.Rat).Add(new(big.Rat).Mul(x, big.NewRat(10, 1)), big.NewRat(1, 2))
+		tenths := new(big.Int).Div(x.Num(), x.Denom())
+		return new(big.Rat).SetFrac(tenths, big.NewInt(10)).FloatString(1)
+	}
+
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	entries := make([]string, len(names))
+	for i, name := range names {
+		s := stats[name]
+		mean := new(big.Rat).Quo(&s.Sum, new(big.Rat).SetInt64(s.Count))
+		entries[i] = name + "=" + format(&s.Min) + "/" + format(mean) + "/" + format(&s.Max)
+	}
+	return "{" + strings.Join(entries, ", ") + "}\n"
+}
+
+func TestRandomized(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		// few stations and a narrow range of temperatures make ties of means likely
+		var data strings.Builder
+		stations := 1 + r.Intn(20)
+		spread := []int64{3, 30, 1999}[r.Intn(3)]
+		for j := r.Intn(2000); j >= 0; j-- {
+			name := strings.Repeat(string(rune('a'+r.Intn(stations))), 1+r.Intn(5))
+			v := r.Int63n(spread) - spread/2
+			fmt.Fprintf(&data, "%s;%s\n", name, appendTenths(nil, v))
+		}
+
+		name := filepath.Join(t.TempDir(), "measurements.txt")
+		if err := os.WriteFile(name, []byte(data.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := exactResults(data.String())
+		numParsers, chunkSize := 1+r.Intn(4), 1+r.Intn(1000)
+		if got := results(t, name, numParsers, chunkSize); got != expected {
+			t.Fatalf("Wrong results with %d parsers and chunk size %d:\n%s\nexpected:\n%s", numParsers, chunkSize, got, expected)
+		}
+	}
+}
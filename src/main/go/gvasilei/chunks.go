@@ -0,0 +1,43 @@
+package main
+
+import "bytes"
+
+// planChunks splits data into at most n chunks of roughly equal size.
+//
+// The chunks cover data exactly: the first one starts at 0, each next one starts
+// where the previous one ends and the last one ends at len(data).
+// Every chunk but the last ends right after a '\n' so no line is ever split,
+// the last one ends at len(data) whether or not data ends with a newline.
+// Chunks are never empty, so no chunks are returned for empty data.
+func planChunks(data []byte, n int) []Chunk {
+	size := int64(len(data))
+	if n < 1 {
+		n = 1
+	}
+
+	chunkSize := size / int64(n)
+	if chunkSize == 0 {
+		chunkSize = 1
+	}
+
+	chunks := make([]Chunk, 0, n)
+	start := int64(0)
+	for start < size {
+		end := start + chunkSize
+		if end >= size || len(chunks) == n-1 {
+			end = size
+		} else if data[end-1] != '\n' {
+			// extend the chunk up to and including the next newline
+			nlPos := bytes.IndexByte(data[end:], '\n')
+			if nlPos == -1 {
+				end = size
+			} else {
+				end += int64(nlPos) + 1
+			}
+		}
+
+		chunks = append(chunks, Chunk{start, end})
+		start = end
+	}
+	return chunks
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPlanChunks(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"\n",
+		"a;1.0",
+		"a;1.0\n",
+		"a;1.0\nb;2.0",
+		"a;1.0\nb;2.0\n",
+		"Petropavlovsk-Kamchatsky;-12.3\nBosaso;4.5\nab;-0.1\nc;99.9\n",
+		"Petropavlovsk-Kamchatsky;-12.3\nBosaso;4.5\nab;-0.1\nc;99.9",
+	} {
+		for n := 0; n <= len(data)+2; n++ {
+			chunks := planChunks([]byte(data), n)
+			checkChunks(t, []byte(data), n, chunks)
+		}
+	}
+}
+
+func checkChunks(t *testing.T, data []byte, n int, chunks []Chunk) {
+	t.Helper()
+
+	if len(data) == 0 && len(chunks) != 0 {
+		t.Errorf("%q/%d: expected no chunks, got: %v", data, n, chunks)
+	}
+	if len(chunks) > max(n, 1) {
+		t.Errorf("%q/%d: expected at most %d chunks, got: %v", data, n, max(n, 1), chunks)
+	}
+
+	start := int64(0)
+	for i, chunk := range chunks {
+		if chunk.start != start {
+			t.Errorf("%q/%d: chunk %d should start at %d, got: %v", data, n, i, start, chunks)
+		}
+		if chunk.end <= chunk.start {
+			t.Errorf("%q/%d: chunk %d is empty: %v", data, n, i, chunks)
+		}
+		if i < len(chunks)-1 && data[chunk.end-1] != '\n' {
+			t.Errorf("%q/%d: chunk %d splits a line: %v", data, n, i, chunks)
+		}
+		if bytes.IndexByte(data[chunk.start:chunk.end], '\n') == -1 && chunk.end != int64(len(data)) {
+			t.Errorf("%q/%d: chunk %d has no complete line: %v", data, n, i, chunks)
+		}
+		start = chunk.end
+	}
+	if start != int64(len(data)) {
+		t.Errorf("%q/%d: chunks should end at %d, got: %v", data, n, len(data), chunks)
+	}
+}
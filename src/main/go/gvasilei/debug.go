@@ -0,0 +1,66 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime/metrics"
+)
+
+// processedBytes is the number of bytes of processed chunks, published to follow progress of long runs.
+var processedBytes = expvar.NewInt("processed_bytes")
+
+func init() {
+	expvar.Publish("runtime_metrics", expvar.Func(readRuntimeMetrics))
+}
+
+// startDebugServer serves net/http/pprof under /debug/pprof/ and expvar runtime metrics
+// under /debug/vars on addr in the background for the duration of the run.
+func startDebugServer(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Serving http://%s/debug/pprof/ and http://%s/debug/vars\n", ln.Addr(), ln.Addr())
+
+	go func() {
+		if err := http.Serve(ln, nil); err != nil {
+			log.Println("Debug server stopped: ", err)
+		}
+	}()
+	return nil
+}
+
+// readRuntimeMetrics returns current values of all scalar runtime/metrics keyed by name,
+// histograms are left out.
+func readRuntimeMetrics() any {
+	descs := metrics.All()
+	samples := make([]metrics.Sample, len(descs))
+	for i := range descs {
+		samples[i].Name = descs[i].Name
+	}
+	metrics.Read(samples)
+
+	values := make(map[string]any, len(samples))
+	for _, sample := range samples {
+		switch sample.Value.Kind() {
+		case metrics.KindUint64:
+			values[sample.Name] = sample.Value.Uint64()
+		case metrics.KindFloat64:
+			values[sample.Name] = sample.Value.Float64()
+		}
+	}
+	return values
+}
+
+// createProfile creates file name in the profiles directory, creating the directory if needed.
+func createProfile(name string) (*os.File, error) {
+	if err := os.MkdirAll(*profilesDir, 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(filepath.Join(*profilesDir, name))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Exit codes, so that pipelines can tell a bad run from a good one.
+const (
+	exitOK             = 0
+	exitInternal       = 1
+	exitUsage          = 2 // same as flag.ExitOnError
+	exitIO             = 3
+	exitMalformedInput = 4
+)
+
+var (
+	errInternal       = errors.New("internal error")
+	errUsage          = errors.New("usage error")
+	errIO             = errors.New("I/O error")
+	errMalformedInput = errors.New("malformed input")
+)
+
+// exitCode returns the exit code for the error returned by run.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.Is(err, errIO):
+		return exitIO
+	case errors.Is(err, errMalformedInput):
+		return exitMalformedInput
+	default:
+		return exitInternal
+	}
+}
+
+// malformedLine returns an errMalformedInput error for the line of the block starting at pos.
+func malformedLine(block Block, pos int, reason string) error {
+	line := block.data[pos:]
+	for i, b := range line {
+		if b == '\n' {
+			line = line[:i]
+			break
+		}
+	}
+	return fmt.Errorf("%w at offset %d: %s: %q", errMalformedInput, block.offset+int64(pos), reason, line)
+}
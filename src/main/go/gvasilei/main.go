@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -10,7 +11,9 @@ import (
 	"runtime/pprof"
 	"runtime/trace"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 type Chunk struct {
@@ -18,226 +21,472 @@ type Chunk struct {
 	end   int64
 }
 
+// Block is a line-aligned part of the input that workers process.
+type Block struct {
+	id     int // sequence number of the block in the input
+	data   []byte
+	offset int64 // of data in the input
+
+	// buf is returned to free once data is processed, for blocks read from a stream
+	buf  []byte
+	free chan<- []byte
+}
+
+// TemperatureStats keeps temperatures as integer tenths of a degree so that
+// aggregation is exact and does not depend on the order results are merged in.
 type TemperatureStats struct {
-	min   float64
-	max   float64
-	sum   float64
-	count int
-	avg   float64
+	min   int16
+	max   int16
+	sum   int64
+	count int64
+	avg   int64
 }
 
+// add adds a temperature to stats, it initializes empty stats.
+func (stats *TemperatureStats) add(temperature int16) {
+	if stats.count == 0 {
+		stats.min = temperature
+		stats.max = temperature
+	} else if temperature < stats.min {
+		stats.min = temperature
+	} else if temperature > stats.max {
+		stats.max = temperature
+	}
+	stats.sum += int64(temperature)
+	stats.count++
+}
+
+// merge adds other to stats, it initializes empty stats.
+func (stats *TemperatureStats) merge(other *TemperatureStats) {
+	if stats.count == 0 {
+		*stats = *other
+		return
+	}
+	stats.min = min(stats.min, other.min)
+	stats.max = max(stats.max, other.max)
+	stats.sum += other.sum
+	stats.count += other.count
+}
+
+// String returns stats as min/mean/max with one decimal place.
 func (stats TemperatureStats) String() string {
-	return fmt.Sprintf("Min: %.2f, Max: %.2f, Avg: %.2f", stats.min, stats.max, stats.avg)
+	b := make([]byte, 0, 20)
+	b = appendTenths(b, int64(stats.min))
+	b = append(b, '/')
+	b = appendTenths(b, stats.avg)
+	b = append(b, '/')
+	b = appendTenths(b, int64(stats.max))
+	return string(b)
 }
 
-var measurementsFile = flag.String("measurements", "", "file with measurements")
+var measurementsFile = flag.String("measurements", "-", "file with measurements, - or empty to read from stdin")
+var profilesDir = flag.String("profiles", "./profiles", "write trace and profiles to `directory`")
 var traceFile = flag.String("trace", "", "write trace execution to `file`")
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to `file`")
 var memprofile = flag.String("memprofile", "", "write memory profile to `file`")
+var blockprofile = flag.String("blockprofile", "", "write goroutine blocking profile to `file`")
+var mutexprofile = flag.String("mutexprofile", "", "write mutex contention profile to `file`")
+var reportFile = flag.String("report", "", "write a JSON run report to `file`, - for stderr")
+var debugAddr = flag.String("debug-addr", "", "serve net/http/pprof and runtime metrics on `address` during the run, e.g. localhost:6060")
 
 var MAX_CITY_NUM = 10000
 
+// size of chunks workers pull from the queue, small enough to balance the load
+// and large enough to keep the queue overhead negligible
+var CHUNK_SIZE = 4 * 1024 * 1024
+
 func main() {
+	err := run()
+	if err != nil {
+		log.Printf("Error: %v", err)
+	}
+	os.Exit(exitCode(err))
+}
+
+// run returns once deferred profiles are written so that main can exit with a meaningful code.
+func run() error {
+	started := time.Now()
 	log.Println("Starting the application...")
 	flag.Parse()
 
-	if *measurementsFile == "" {
-		log.Fatal("Missing measurements filename")
+	if flag.NArg() > 0 {
+		return fmt.Errorf("%w: unexpected arguments: %v", errUsage, flag.Args())
+	}
+
+	if *debugAddr != "" {
+		if err := startDebugServer(*debugAddr); err != nil {
+			return fmt.Errorf("%w: could not start debug server: %w", errIO, err)
+		}
 	}
 
 	if *traceFile != "" {
-		f, err := os.Create("./profiles/" + *traceFile)
+		f, err := createProfile(*traceFile)
 		if err != nil {
-			log.Fatal("Failed to create trace profile: ", err)
+			return fmt.Errorf("%w: failed to create trace profile: %w", errIO, err)
 		}
 		defer f.Close()
 		err = trace.Start(f)
 		if err != nil {
-			log.Fatal("Failed to start trace: ", err)
+			return fmt.Errorf("%w: failed to start trace: %w", errInternal, err)
 		}
 		defer trace.Stop()
 	}
 
 	if *cpuprofile != "" {
-		f, err := os.Create("./profiles/" + *cpuprofile)
+		f, err := createProfile(*cpuprofile)
 		if err != nil {
-			log.Fatal("could not create CPU profile: ", err)
+			return fmt.Errorf("%w: could not create CPU profile: %w", errIO, err)
 		}
 		defer f.Close() // error handling omitted for example
 		if err := pprof.StartCPUProfile(f); err != nil {
-			log.Fatal("could not start CPU profile: ", err)
+			return fmt.Errorf("%w: could not start CPU profile: %w", errInternal, err)
 		}
 		defer pprof.StopCPUProfile()
 	}
 
-	calculateWithMMap(*measurementsFile)
+	if *blockprofile != "" {
+		runtime.SetBlockProfileRate(1)
+	}
+	if *mutexprofile != "" {
+		runtime.SetMutexProfileFraction(1)
+	}
+
+	err := calculateFile(*measurementsFile)
+	if *reportFile != "" {
+		if reportErr := writeReport(*reportFile, started, err); reportErr != nil && err == nil {
+			err = fmt.Errorf("%w: could not write report: %w", errIO, reportErr)
+		}
+	}
+	if err != nil {
+		return err
+	}
 
 	if *memprofile != "" {
-		f, err := os.Create("./profiles/" + *memprofile)
+		f, err := createProfile(*memprofile)
 		if err != nil {
-			log.Fatal("could not create memory profile: ", err)
+			return fmt.Errorf("%w: could not create memory profile: %w", errIO, err)
 		}
 		defer f.Close()
 		runtime.GC()
 		if err := pprof.WriteHeapProfile(f); err != nil {
-			log.Fatal("could not write memory profile: ", err)
+			return fmt.Errorf("%w: could not write memory profile: %w", errIO, err)
 		}
 	}
+
+	for name, file := range map[string]string{"block": *blockprofile, "mutex": *mutexprofile} {
+		if file == "" {
+			continue
+		}
+		f, err := createProfile(file)
+		if err != nil {
+			return fmt.Errorf("%w: could not create %s profile: %w", errIO, name, err)
+		}
+		defer f.Close()
+		if err := pprof.Lookup(name).WriteTo(f, 0); err != nil {
+			return fmt.Errorf("%w: could not write %s profile: %w", errIO, name, err)
+		}
+	}
+	return nil
 }
 
-func calculateWithMMap(measurementsFile string) {
-	file, err := os.Open(measurementsFile)
-	if err != nil {
-		fmt.Println("Error: ", err)
-		return
+// calculateFile outputs stats of measurementsFile, or of stdin if it is - or empty.
+// Regular files are mmapped, other inputs like pipes are streamed.
+func calculateFile(measurementsFile string) error {
+	started := time.Now()
+	report.Input = measurementsFile
+
+	file := os.Stdin
+	if measurementsFile != "" && measurementsFile != "-" {
+		f, err := os.Open(measurementsFile)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errIO, err)
+		}
+		defer f.Close()
+		file = f
 	}
-	defer file.Close()
 
 	fileInfo, err := file.Stat()
 	if err != nil {
-		fmt.Println("Error getting file stats:", err)
-		return
+		return fmt.Errorf("%w: %w", errIO, err)
 	}
 
-	fileSize := fileInfo.Size()
-	numWorkers := runtime.NumCPU()
-
-	chunkSize := fileSize / int64(numWorkers)
-	results := make(chan map[string]*TemperatureStats, numWorkers)
-	stats := make(map[string]*TemperatureStats, MAX_CITY_NUM)
-
-	data, err := syscall.Mmap(int(file.Fd()), 0, int(fileSize), syscall.PROT_READ, syscall.MAP_SHARED)
+	var stats map[string]*TemperatureStats
+	if fileInfo.Mode().IsRegular() {
+		report.Mode = "mmap"
+		stats, err = calculateWithMMap(file, fileInfo, started)
+	} else {
+		log.Printf("Streaming %s\n", file.Name())
+		report.Mode = "stream"
+		report.Phases.Open = time.Since(started)
+		stats, err = calculateStream(file, runtime.NumCPU(), CHUNK_SIZE)
+	}
 	if err != nil {
-		log.Fatalf("Mmap: %v", err)
+		return err
 	}
 
-	defer func() {
-		if err := syscall.Munmap(data); err != nil {
-			log.Fatalf("Munmap: %v", err)
-		}
-	}()
+	log.Println("Outputting stats...")
+	started = time.Now()
 
-	var wg sync.WaitGroup
+	if err := writeResults(os.Stdout, stats); err != nil {
+		return fmt.Errorf("%w: write results: %w", errIO, err)
+	}
+	report.Phases.Output = time.Since(started)
+	return nil
+}
 
-	start := int64(0)
-	end := int64(0)
-	for i := 0; i < numWorkers; i++ {
-		end = start + chunkSize
-		if end > fileSize {
-			end = fileSize
+func calculateWithMMap(file *os.File, fileInfo os.FileInfo, started time.Time) (stats map[string]*TemperatureStats, err error) {
+	fileSize := fileInfo.Size()
+	if fileSize != int64(int(fileSize)) {
+		return nil, fmt.Errorf("%w: file is too large to mmap: %d bytes", errIO, fileSize)
+	}
+
+	// Mmap fails on empty files, there is nothing to map anyway
+	var data []byte
+	if fileSize > 0 {
+		data, err = syscall.Mmap(int(file.Fd()), 0, int(fileSize), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err != nil {
+			return nil, fmt.Errorf("%w: mmap: %w", errIO, err)
 		}
 
-		// Read bytes until you find a newline character, indicating the start of a new line
-		for {
-			// fmt.Printf("Line Worker %d - read byte file: %c\n", id, b[0])
-			if data[end-1] == '\n' || end >= fileSize {
-				//fmt.Printf("Worker %d - Found newline at %d\n", i, end)
-				break
+		defer func() {
+			if unmapErr := syscall.Munmap(data); unmapErr != nil && err == nil {
+				err = fmt.Errorf("%w: munmap: %w", errIO, unmapErr)
 			}
-			end += 1
-		}
+		}()
+	}
 
-		chunk := Chunk{start, end}
+	report.Phases.Open = time.Since(started)
 
-		log.Printf("Adding worker %d to read file from %d up to %d \n", i+1, start, end)
-		wg.Add(1)
-		go processLinesWithMMap(i+1, chunk, data, &wg, results)
-		start = end + 1
+	// results are copied out of data by toMap so it can be unmapped
+	return calculate(data, runtime.NumCPU(), CHUNK_SIZE)
+}
+
+// calculate splits data into line-aligned chunks of about chunkSize bytes
+// that numWorkers goroutines pull from a shared queue, and merges the results.
+func calculate(data []byte, numWorkers int, chunkSize int) (map[string]*TemperatureStats, error) {
+	ctx, task := trace.NewTask(context.Background(), "calculate")
+	defer task.End()
+
+	// at least one chunk per worker
+	chunks := planChunks(data, max(numWorkers, len(data)/max(chunkSize, 1)))
+	log.Printf("Split file into %d chunks of about %d bytes\n", len(chunks), len(data)/max(len(chunks), 1))
+
+	queue := make(chan Block, len(chunks))
+	report.Chunks = make([]ChunkReport, 0, len(chunks))
+	for i, chunk := range chunks {
+		report.Chunks = append(report.Chunks, ChunkReport{chunk.start, chunk.end})
+		queue <- Block{id: i, data: data[chunk.start:chunk.end], offset: chunk.start}
+	}
+	close(queue)
+
+	// idle workers would only add empty stats to merge
+	return aggregate(ctx, queue, min(numWorkers, len(chunks)))
+}
+
+// aggregate processes blocks from the queue with numWorkers goroutines until
+// it is closed and merges the results.
+// It returns the first error any worker runs into.
+//
+// Each block is traced as a "chunk" task of ctx with a "scan" region, names
+// are hashed while scanning for ';' so hashing is part of the region.
+// Results of each worker are merged in a "merge" region.
+func aggregate(ctx context.Context, queue <-chan Block, numWorkers int) (map[string]*TemperatureStats, error) {
+	started := time.Now()
+	results := make(chan workerResult, numWorkers)
+	stats := newStatsTable(MAX_CITY_NUM)
 
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+
+	for i := 0; i < numWorkers; i++ {
+		log.Printf("Adding worker %d\n", i+1)
+		wg.Add(1)
+		go worker(ctx, i+1, queue, &stop, &wg, results)
 	}
 
 	wg.Wait()
 	close(results)
+	report.Phases.Parse = time.Since(started)
 
 	log.Println("Merging results...")
-	for resultsMap := range results {
-		for city, recording := range resultsMap {
-			existingRecording, exists := stats[city]
-			if !exists {
-				stats[city] = recording
-			} else {
-				if recording.min < existingRecording.min {
-					existingRecording.min = recording.min
-				}
-				if recording.max > existingRecording.max {
-					existingRecording.max = recording.max
-				}
-				existingRecording.sum += recording.sum
-				existingRecording.count += recording.count
+	started = time.Now()
+	report.Workers = make([]WorkerReport, 0, numWorkers)
+	var err error
+	for result := range results {
+		if result.err != nil {
+			if err == nil {
+				err = result.err
 			}
+			continue
 		}
+
+		report.Workers = append(report.Workers, WorkerReport{result.id, result.blocks, result.bytes, result.rows})
+		report.Bytes += result.bytes
+		report.Rows += result.rows
+
+		if err == nil {
+			region := trace.StartRegion(ctx, "merge")
+			trace.Logf(ctx, "merge", "worker=%d stations=%d", result.id, result.stats.len)
+			if !stats.merge(result.stats) {
+				err = fmt.Errorf("%w: more than %d stations", errMalformedInput, MAX_CITY_NUM)
+			}
+			region.End()
+		}
+	}
+	report.Phases.Merge = time.Since(started)
+	if err != nil {
+		return nil, err
 	}
 
 	log.Println("Calculating averages...")
-	for city, recording := range stats {
-		recording.avg = recording.sum / float64(recording.count)
-		stats[city] = recording
+	defer trace.StartRegion(ctx, "finalize").End()
+	started = time.Now()
+	for i := range stats.entries {
+		recording := &stats.entries[i].stats
+		if recording.count > 0 {
+			recording.avg = mean(recording.sum, recording.count)
+		}
 	}
-	log.Println("Outputting stats...")
 
-	fmt.Print(stats)
+	result := stats.toMap()
+	report.Stations = len(result)
+	report.Phases.Finalize = time.Since(started)
+	return result, nil
 }
 
-func processLinesWithMMap(id int, chunk Chunk, data []byte, wg *sync.WaitGroup, results chan<- map[string]*TemperatureStats) {
+type workerResult struct {
+	id     int
+	blocks int
+	bytes  int64
+	rows   int64
+	stats  *statsTable
+	err    error
+}
+
+// worker processes blocks from the queue until it is drained and sends
+// the stats aggregated over all of them to results.
+// It stops early once stop is set and sets it when it fails itself.
+func worker(ctx context.Context, id int, queue <-chan Block, stop *atomic.Bool, wg *sync.WaitGroup, results chan<- workerResult) {
 	defer wg.Done()
 
-	stats := make(map[string]*TemperatureStats, MAX_CITY_NUM)
-	// Process lines until the end of this chunk
-	//r := bufio.NewReader(file)
-
-	b := data[chunk.start:chunk.end]
-
-	offset := 0
-	for offset < len(b) {
-
-		newLinePos := bytes.IndexByte(b[offset:], '\n')
-		line := b[offset : offset+newLinePos]
-		//fmt.Printf("Worker %d - Processing line: %s\n", id, line)
-		// Process the line
-		cityB, temperatureB, _ := bytes.Cut(line, []byte(";"))
-		temperature := parseFloat(temperatureB)
-
-		recording, exists := stats[string(cityB)]
-		if !exists {
-			stats[string(cityB)] = &TemperatureStats{temperature, temperature, temperature, 1, 0.0}
-		} else {
-			if temperature < recording.min {
-				recording.min = temperature
-			} else if temperature > recording.max {
-				recording.max = temperature
-			}
-			recording.sum += temperature
-			recording.count++
+	result := workerResult{id: id, stats: newStatsTable(MAX_CITY_NUM)}
+	defer func() {
+		if r := recover(); r != nil {
+			result.err = fmt.Errorf("%w: worker %d: %v", errInternal, id, r)
 		}
+		if result.err != nil {
+			stop.Store(true)
+		}
+		results <- result
+	}()
 
-		offset += (newLinePos + 1)
-
+	for block := range queue {
+		if stop.Load() {
+			return
+		}
+		chunkCtx, task := trace.NewTask(ctx, "chunk")
+		trace.Logf(chunkCtx, "chunk", "id=%d start=%d end=%d worker=%d", block.id, block.offset, block.offset+int64(len(block.data)), id)
+		region := trace.StartRegion(chunkCtx, "scan")
+		rows, err := processLines(block, result.stats)
+		region.End()
+		trace.Logf(chunkCtx, "rows", "%d", rows)
+		task.End()
+
+		if result.err = err; err != nil {
+			return
+		}
+		if block.free != nil {
+			block.free <- block.buf
+		}
+		processedBytes.Add(int64(len(block.data)))
+		result.blocks++
+		result.bytes += int64(len(block.data))
+		result.rows += rows
 	}
+	log.Printf("Worker %d processed %d blocks, %d bytes\n", id, result.blocks, result.bytes)
+}
 
-	results <- stats
+// processLines adds measurements of the block to stats and returns the number of rows.
+func processLines(block Block, stats *statsTable) (int64, error) {
+	// Process lines until the end of this block
+	b := block.data
+	rows := int64(0)
+	for ; len(b) > 0; rows++ {
+		line := b
+
+		// hash the city while looking for the separator
+		semiPos, hash := scanName(b)
+		if semiPos == len(b) {
+			return rows, malformedLine(block, len(block.data)-len(line), "missing ';'")
+		}
+		cityB := b[:semiPos]
+		b = b[semiPos+1:]
+
+		newLinePos := bytes.IndexByte(b, '\n')
+		if newLinePos == -1 {
+			// last line without trailing newline
+			newLinePos = len(b)
+		}
+		temperature, ok := parseTemperature(b[:newLinePos])
+		if !ok {
+			return rows, malformedLine(block, len(block.data)-len(line), "invalid temperature")
+		}
+		b = b[min(newLinePos+1, len(b)):]
+
+		if len(cityB) == 0 || len(cityB) > MAX_NAME_LEN {
+			return rows, malformedLine(block, len(block.data)-len(line), fmt.Sprintf("station name must be 1 to %d bytes long", MAX_NAME_LEN))
+		}
+		recording := stats.get(hash, cityB)
+		if recording == nil {
+			return rows, malformedLine(block, len(block.data)-len(line), fmt.Sprintf("more than %d stations", MAX_CITY_NUM))
+		}
+		recording.add(temperature)
+	}
+	return rows, nil
 }
 
-func parseFloat(b []byte) float64 {
+// parseTemperature reads decimal number that matches "^-?[0-9]{1,2}[.][0-9]" pattern
+// and returns its value in tenths, e.g. -12.3 is returned as -123.
+// It returns false if b does not match the pattern.
+func parseTemperature(b []byte) (int16, bool) {
 	i := 0
 	isNegative := false
-	if b[0] == '-' {
+	if len(b) > 0 && b[0] == '-' {
 		isNegative = true
 		i++
 	}
 
-	temp := float64(b[i] - '0')
+	// d.d or dd.d
+	if n := len(b) - i; n != 3 && n != 4 || b[len(b)-2] != '.' {
+		return 0, false
+	}
+
+	if !isDigit(b[i]) {
+		return 0, false
+	}
+	temp := int16(b[i] - '0')
 	i++
 
 	if b[i] != '.' {
-		temp = temp*10 + float64(b[i]-'0')
+		if !isDigit(b[i]) {
+			return 0, false
+		}
+		temp = temp*10 + int16(b[i]-'0')
 		i++
 	}
 
 	i++
-	temp += float64(b[i]-'0') / 10 // parse decimal digit
+	if !isDigit(b[i]) {
+		return 0, false
+	}
+	temp = temp*10 + int16(b[i]-'0') // parse decimal digit
 	if isNegative {
 		temp = -temp
 	}
 
-	return temp
+	return temp, true
+}
+
+func isDigit(b byte) bool {
+	return b-'0' <= 9
 }
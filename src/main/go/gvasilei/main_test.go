@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const samplesDir = "../../../test/resources/samples"
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func TestMean(t *testing.T) {
+	for _, tc := range []struct {
+		sum, count int64
+		expected   string
+	}{
+		{sum: -31, count: 2, expected: "-1.5"},
+		{sum: -10, count: 1, expected: "-1.0"},
+		{sum: -7, count: 10, expected: "-0.1"},
+		{sum: -5, count: 10, expected: "0.0"},
+		{sum: -3, count: 10, expected: "0.0"},
+		{sum: 0, count: 1, expected: "0.0"},
+		{sum: 3, count: 10, expected: "0.0"},
+		{sum: 5, count: 10, expected: "0.1"},
+		{sum: 7, count: 10, expected: "0.1"},
+		{sum: 10, count: 1, expected: "1.0"},
+		{sum: 31, count: 2, expected: "1.6"},
+		{sum: -9990, count: 10, expected: "-99.9"},
+		{sum: 1998, count: 2, expected: "99.9"},
+	} {
+		if m := appendTenths(nil, mean(tc.sum, tc.count)); string(m) != tc.expected {
+			t.Errorf("Wrong mean of %d/%d, expected: %s, got: %s", tc.sum, tc.count, tc.expected, m)
+		}
+	}
+}
+
+func TestParseTemperature(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected int16
+	}{
+		{value: "-99.9", expected: -999},
+		{value: "-12.3", expected: -123},
+		{value: "-1.5", expected: -15},
+		{value: "-0.0", expected: 0},
+		{value: "0.0", expected: 0},
+		{value: "0.3", expected: 3},
+		{value: "12.3", expected: 123},
+		{value: "99.9", expected: 999},
+	} {
+		if temp, ok := parseTemperature([]byte(tc.value)); !ok || temp != tc.expected {
+			t.Errorf("Wrong parsing of %v, expected: %d, got: %d, %v", tc.value, tc.expected, temp, ok)
+		}
+	}
+
+	for _, value := range []string{"", "-", "1", "1.", ".1", "-.1", "1.23", "123.4", "+1.2", "a.1", "1.a", "1a.2", "--1.2", "1.2\r"} {
+		if temp, ok := parseTemperature([]byte(value)); ok {
+			t.Errorf("Expected parsing of %q to fail, got: %d", value, temp)
+		}
+	}
+}
+
+func TestCalculateSamples(t *testing.T) {
+	samples, err := filepath.Glob(filepath.Join(samplesDir, "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sample := range samples {
+		t.Run(filepath.Base(sample), func(t *testing.T) {
+			data, err := os.ReadFile(sample)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := os.ReadFile(strings.TrimSuffix(sample, ".txt") + ".out")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			unterminated := bytes.TrimSuffix(data, []byte("\n"))
+			for _, numWorkers := range []int{1, 2, 3, 16} {
+				for _, chunkSize := range []int{1, 100, CHUNK_SIZE} {
+					for _, input := range [][]byte{data, unterminated} {
+						var out bytes.Buffer
+						stats, err := calculate(input, numWorkers, chunkSize)
+						if err != nil {
+							t.Fatal(err)
+						}
+						if err := writeResults(&out, stats); err != nil {
+							t.Fatal(err)
+						}
+						if out.String() != string(expected) {
+							t.Errorf("Wrong results with %d workers and %d byte chunks, expected:\n%s\ngot:\n%s", numWorkers, chunkSize, expected, out.String())
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCalculateEmpty(t *testing.T) {
+	stats, err := calculate(nil, 8, CHUNK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := writeResults(&out, stats); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "{}\n" {
+		t.Errorf("Wrong results, expected: {}, got: %s", out.String())
+	}
+}
+
+func TestCalculateMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		data     string
+		expected string
+	}{
+		{data: "a;1.0\nb\nc;2.0\n", expected: `malformed input at offset 6: missing ';': "b"`},
+		{data: "a;1.0\nb;\n", expected: `malformed input at offset 6: invalid temperature: "b;"`},
+		{data: "a;1.0\nb;12.34", expected: `malformed input at offset 6: invalid temperature: "b;12.34"`},
+		{data: "a;1.0\n;1.0\n", expected: `malformed input at offset 6: station name must be 1 to 100 bytes long: ";1.0"`},
+		{data: "a;1.0\n\n", expected: `malformed input at offset 6: missing ';': ""`},
+		{data: strings.Repeat("x", MAX_NAME_LEN+1) + ";1.0\n", expected: `malformed input at offset 0: station name must be 1 to 100 bytes long`},
+	} {
+		for _, numWorkers := range []int{1, 3} {
+			_, err := calculate([]byte(tc.data), numWorkers, 1)
+			if !errors.Is(err, errMalformedInput) || !strings.HasPrefix(err.Error(), tc.expected) {
+				t.Errorf("Wrong error for %q, expected: %s, got: %v", tc.data, tc.expected, err)
+			}
+			if exitCode(err) != exitMalformedInput {
+				t.Errorf("Wrong exit code for %q, expected: %d, got: %d", tc.data, exitMalformedInput, exitCode(err))
+			}
+		}
+	}
+}
+
+func TestCalculateTooManyStations(t *testing.T) {
+	var data bytes.Buffer
+	for i := 0; i <= MAX_CITY_NUM; i++ {
+		fmt.Fprintf(&data, "station%d;1.0\n", i)
+	}
+
+	for _, numWorkers := range []int{1, 4} {
+		_, err := calculate(data.Bytes(), numWorkers, 1024)
+		if !errors.Is(err, errMalformedInput) || !strings.Contains(err.Error(), "more than 10000 stations") {
+			t.Errorf("Wrong error with %d workers, got: %v", numWorkers, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// writeResults writes stats in the reference 1brc format, i.e.
+// {Abha=-23.0/18.0/59.2, Abidjan=-16.2/26.0/67.3, ...} with stations sorted by name.
+func writeResults(w io.Writer, stats map[string]*TemperatureStats) error {
+	cities := make([]string, 0, len(stats))
+	for city := range stats {
+		cities = append(cities, city)
+	}
+	sort.Strings(cities)
+
+	bw := bufio.NewWriter(w)
+	bw.WriteByte('{')
+	for i, city := range cities {
+		if i > 0 {
+			bw.WriteString(", ")
+		}
+		bw.WriteString(city)
+		bw.WriteByte('=')
+		bw.WriteString(stats[city].String())
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// mean returns sum/count rounded to the closest integer with ties rounding
+// towards positive infinity, like the reference implementation's Math.round.
+// Both sum and the result are in tenths of a degree.
+func mean(sum, count int64) int64 {
+	// floor((2*sum + count) / (2*count)), i.e. floor(sum/count + 0.5)
+	n, d := 2*sum+count, 2*count
+	q := n / d
+	if n%d != 0 && n < 0 {
+		q--
+	}
+	return q
+}
+
+// appendTenths appends v tenths of a degree formatted with one decimal place,
+// e.g. -123 is appended as -12.3. Zero is always formatted as 0.0, never -0.0.
+func appendTenths(b []byte, v int64) []byte {
+	if v < 0 {
+		b = append(b, '-')
+		v = -v
+	}
+	b = strconv.AppendInt(b, v/10, 10)
+	return append(b, '.', byte('0'+v%10))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// RunReport is a machine-readable summary of a run, written as JSON with -report.
+type RunReport struct {
+	Input      string         `json:"input"`
+	Mode       string         `json:"mode"` // mmap or stream
+	Error      string         `json:"error,omitempty"`
+	WallTime   time.Duration  `json:"wall_time_ns"`
+	Phases     PhaseTimes     `json:"phases"`
+	Bytes      int64          `json:"bytes"`
+	Rows       int64          `json:"rows"`
+	Stations   int            `json:"stations"`
+	PeakRSS    int64          `json:"peak_rss_bytes"`
+	Workers    []WorkerReport `json:"workers"`
+	Chunks     []ChunkReport  `json:"chunks"`
+	NumCPU     int            `json:"num_cpu"`
+	GoMaxProcs int            `json:"gomaxprocs"`
+	GoVersion  string         `json:"go_version"`
+	StartedAt  time.Time      `json:"started_at"`
+	ChunkSize  int            `json:"chunk_size"`
+}
+
+// PhaseTimes is the wall time of each phase of a run.
+// For streamed input the time to read it is part of Parse.
+type PhaseTimes struct {
+	Open     time.Duration `json:"open_ns"`
+	Parse    time.Duration `json:"parse_ns"`
+	Merge    time.Duration `json:"merge_ns"`
+	Finalize time.Duration `json:"finalize_ns"`
+	Output   time.Duration `json:"output_ns"`
+}
+
+type WorkerReport struct {
+	ID     int   `json:"id"`
+	Blocks int   `json:"blocks"`
+	Bytes  int64 `json:"bytes"`
+	Rows   int64 `json:"rows"`
+}
+
+// ChunkReport is the [Start, End) byte range of a chunk of the input.
+type ChunkReport struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// report of the current run, filled in by each phase.
+var report RunReport
+
+// writeReport finishes the report and writes it to file, or to stderr if file is -.
+func writeReport(file string, started time.Time, err error) error {
+	report.WallTime = time.Since(started)
+	report.StartedAt = started
+	report.PeakRSS = peakRSS()
+	report.NumCPU = runtime.NumCPU()
+	report.GoMaxProcs = runtime.GOMAXPROCS(0)
+	report.GoVersion = runtime.Version()
+	report.ChunkSize = CHUNK_SIZE
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	b, err := json.MarshalIndent(&report, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if file == "-" {
+		_, err = os.Stderr.Write(b)
+		return err
+	}
+	return os.WriteFile(file, b, 0644)
+}
+
+// peakRSS returns the maximum resident set size of the process in bytes.
+func peakRSS() int64 {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	// bytes on macOS, kilobytes elsewhere
+	if runtime.GOOS == "darwin" {
+		return int64(usage.Maxrss)
+	}
+	return int64(usage.Maxrss) * 1024
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReport(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join(samplesDir, "measurements-10000-unique-keys.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := int64(bytes.Count(data, []byte("\n")))
+
+	for name, calc := range map[string]func() (map[string]*TemperatureStats, error){
+		"mmap":   func() (map[string]*TemperatureStats, error) { return calculate(data, 3, 4096) },
+		"stream": func() (map[string]*TemperatureStats, error) { return calculateStream(bytes.NewReader(data), 3, 4096) },
+	} {
+		report = RunReport{}
+		if _, err := calc(); err != nil {
+			t.Fatal(err)
+		}
+
+		if report.Rows != rows || report.Bytes != int64(len(data)) || report.Stations != 10000 {
+			t.Errorf("%s: wrong totals, expected: %d rows, %d bytes, 10000 stations, got: %+v", name, rows, len(data), report)
+		}
+
+		var workerRows, workerBytes int64
+		for _, w := range report.Workers {
+			workerRows += w.Rows
+			workerBytes += w.Bytes
+		}
+		if len(report.Workers) != 3 || workerRows != rows || workerBytes != int64(len(data)) {
+			t.Errorf("%s: wrong workers: %+v", name, report.Workers)
+		}
+
+		start := int64(0)
+		for _, c := range report.Chunks {
+			if c.Start != start || c.End <= c.Start {
+				t.Errorf("%s: wrong chunks: %+v", name, report.Chunks)
+				break
+			}
+			start = c.End
+		}
+		if start != int64(len(data)) {
+			t.Errorf("%s: chunks should end at %d, got: %d", name, len(data), start)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"runtime/trace"
+)
+
+// calculateStream reads r in line-aligned blocks of up to blockSize bytes that
+// numWorkers goroutines process as they are read, and merges the results.
+// At most 2*numWorkers blocks are buffered, so that the reader fills one while
+// workers process others.
+func calculateStream(r io.Reader, numWorkers int, blockSize int) (map[string]*TemperatureStats, error) {
+	ctx, task := trace.NewTask(context.Background(), "calculate")
+	defer task.End()
+
+	queue := make(chan Block, numWorkers)
+	report.Chunks = nil
+	done := make(chan struct{})
+	readErr := make(chan error, 1)
+
+	go func() {
+		readErr <- readBlocks(ctx, r, blockSize, 2*numWorkers, queue, done)
+	}()
+
+	stats, err := aggregate(ctx, queue, numWorkers)
+
+	// unblock the reader if workers stopped early
+	close(done)
+	if rerr := <-readErr; rerr != nil {
+		return nil, rerr
+	}
+	return stats, err
+}
+
+// readBlocks sends line-aligned blocks of r to the queue until r is drained or done is closed,
+// then closes the queue. Each read is traced as a "read" region of ctx. It allocates up to numBuffers buffers of blockSize bytes
+// and reuses them once workers return them.
+func readBlocks(ctx context.Context, r io.Reader, blockSize int, numBuffers int, queue chan<- Block, done <-chan struct{}) error {
+	defer close(queue)
+
+	free := make(chan []byte, numBuffers)
+	allocated := 0
+	acquire := func() []byte {
+		select {
+		case buf := <-free:
+			return buf
+		default:
+		}
+		if allocated < numBuffers {
+			allocated++
+			return make([]byte, blockSize)
+		}
+		select {
+		case buf := <-free:
+			return buf
+		case <-done:
+			return nil
+		}
+	}
+	send := func(block Block) bool {
+		select {
+		case queue <- block:
+			return true
+		case <-done:
+			return false
+		}
+	}
+
+	offset := int64(0)
+	buf := acquire()
+	n := 0 // bytes of buf filled
+	blocks := 0
+	for buf != nil {
+		region := trace.StartRegion(ctx, "read")
+		m, err := io.ReadFull(r, buf[n:])
+		region.End()
+		n += m
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if n > 0 {
+				// last line may be unterminated
+				send(Block{id: blocks, data: buf[:n], offset: offset, buf: buf, free: free})
+				report.Chunks = append(report.Chunks, ChunkReport{offset, offset + int64(n)})
+				blocks++
+			}
+			log.Printf("Read %d blocks, %d bytes\n", blocks, offset+int64(n))
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%w: read: %w", errIO, err)
+		}
+
+		// buf is full, carry its partial last line over to the next one
+		nlPos := bytes.LastIndexByte(buf, '\n')
+		if nlPos == -1 {
+			return fmt.Errorf("%w at offset %d: line longer than %d bytes", errMalformedInput, offset, blockSize)
+		}
+		next := acquire()
+		if next == nil {
+			return nil
+		}
+		carry := copy(next, buf[nlPos+1:])
+
+		if !send(Block{id: blocks, data: buf[:nlPos+1], offset: offset, buf: buf, free: free}) {
+			return nil
+		}
+		report.Chunks = append(report.Chunks, ChunkReport{offset, offset + int64(nlPos+1)})
+		blocks++
+		offset += int64(nlPos + 1)
+		buf, n = next, carry
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCalculateStreamSamples(t *testing.T) {
+	samples, err := filepath.Glob(filepath.Join(samplesDir, "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sample := range samples {
+		t.Run(filepath.Base(sample), func(t *testing.T) {
+			data, err := os.ReadFile(sample)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := calculate(data, 1, CHUNK_SIZE)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			unterminated := bytes.TrimSuffix(data, []byte("\n"))
+			for _, numWorkers := range []int{1, 3} {
+				for _, blockSize := range []int{256, 4096, CHUNK_SIZE} {
+					for _, input := range [][]byte{data, unterminated} {
+						for _, r := range []io.Reader{bytes.NewReader(input), iotest.HalfReader(bytes.NewReader(input))} {
+							stats, err := calculateStream(r, numWorkers, blockSize)
+							if err != nil {
+								t.Fatal(err)
+							}
+							if len(stats) != len(expected) {
+								t.Fatalf("Wrong number of stations with %d workers and %d byte blocks, expected: %d, got: %d", numWorkers, blockSize, len(expected), len(stats))
+							}
+							for city, recording := range expected {
+								if got := stats[city]; got == nil || *got != *recording {
+									t.Errorf("Wrong stats of %s with %d workers and %d byte blocks, expected: %v, got: %v", city, numWorkers, blockSize, recording, got)
+								}
+							}
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCalculateStreamErrors(t *testing.T) {
+	readErr := errors.New("read failed")
+	for _, tc := range []struct {
+		r        io.Reader
+		expected error
+		message  string
+	}{
+		{r: strings.NewReader(""), expected: nil},
+		{r: iotest.ErrReader(readErr), expected: readErr, message: "I/O error: read: read failed"},
+		{r: io.MultiReader(strings.NewReader("a;1.0\n"), iotest.ErrReader(readErr)), expected: errIO, message: "I/O error: read: read failed"},
+		{r: strings.NewReader("a;1.0\n" + strings.Repeat("b", 100) + ";1.0\n"), expected: errMalformedInput, message: "malformed input at offset 6: line longer than 64 bytes"},
+		{r: strings.NewReader("b;x\n" + strings.Repeat("a;1.0\n", 1000)), expected: errMalformedInput, message: `malformed input at offset 0: invalid temperature: "b;x"`},
+		{r: strings.NewReader(strings.Repeat("a;1.0\n", 100) + "b;x\n"), expected: errMalformedInput, message: `malformed input at offset 600: invalid temperature: "b;x"`},
+	} {
+		_, err := calculateStream(tc.r, 2, 64)
+		if !errors.Is(err, tc.expected) || err != nil && err.Error() != tc.message {
+			t.Errorf("Wrong error, expected: %s, got: %v", tc.message, err)
+		}
+	}
+}
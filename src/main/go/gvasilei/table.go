@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	// maximum length of a station name in bytes, names are stored inline in the table
+	MAX_NAME_LEN = 100
+
+	// hash names 8 bytes at a time with FNV-1a constants
+	fnv1aOffset64 = 14695981039346656037
+	fnv1aPrime64  = 1099511628211
+
+	// from MurmurHash3 fmix64
+	mixMultiplier = 0xff51afd7ed558ccd
+
+	semicolons = 0x3b3b3b3b3b3b3b3b
+	lowBits    = 0x0101010101010101
+	highBits   = 0x8080808080808080
+)
+
+type tableEntry struct {
+	stats   TemperatureStats
+	hash    uint64
+	nameLen int
+	name    [MAX_NAME_LEN]byte
+}
+
+// statsTable is a linear probe hash table of TemperatureStats keyed by station name.
+// Callers hash names with scanName while looking for ';' so the table never
+// hashes keys itself, and entries are stored inline so lookups never allocate.
+type statsTable struct {
+	entries []tableEntry
+	mask    uint64
+	len     int
+	limit   int
+}
+
+// newStatsTable returns a table that holds up to limit stations.
+func newStatsTable(limit int) *statsTable {
+	// use power of 2 for fast modulo calculation, keep it at most 2/3 full
+	size := 1
+	for size < limit+limit/2 {
+		size <<= 1
+	}
+	return &statsTable{
+		entries: make([]tableEntry, size),
+		mask:    uint64(size - 1),
+		limit:   limit,
+	}
+}
+
+// get returns stats of the name with the given hash, adding an empty one
+// if the name is not in the table yet. It returns nil if the name is longer than
+// MAX_NAME_LEN or the table already holds limit stations.
+func (t *statsTable) get(hash uint64, name []byte) *TemperatureStats {
+	i := hash & t.mask
+	entry := &t.entries[i]
+	for entry.stats.count > 0 {
+		if entry.hash == hash && string(entry.name[:entry.nameLen]) == string(name) {
+			return &entry.stats
+		}
+		i = (i + 1) & t.mask
+		entry = &t.entries[i]
+	}
+
+	if len(name) > MAX_NAME_LEN || t.len == t.limit {
+		return nil
+	}
+	entry.hash = hash
+	entry.nameLen = copy(entry.name[:], name)
+	t.len++
+	return &entry.stats
+}
+
+// merge adds all stations of other to t. It returns false if t would hold more
+// than limit stations.
+func (t *statsTable) merge(other *statsTable) bool {
+	for i := range other.entries {
+		entry := &other.entries[i]
+		if entry.stats.count == 0 {
+			continue
+		}
+		stats := t.get(entry.hash, entry.name[:entry.nameLen])
+		if stats == nil {
+			return false
+		}
+		stats.merge(&entry.stats)
+	}
+	return true
+}
+
+// toMap returns stations of the table keyed by name.
+func (t *statsTable) toMap() map[string]*TemperatureStats {
+	stats := make(map[string]*TemperatureStats, t.len)
+	for i := range t.entries {
+		entry := &t.entries[i]
+		if entry.stats.count > 0 {
+			stats[string(entry.name[:entry.nameLen])] = &entry.stats
+		}
+	}
+	return stats
+}
+
+// scanName returns the position of the first ';' in b, or len(b) if there is none,
+// and the hash of the name before it.
+// It reads b 8 bytes at a time, looking for ';' in each word using
+// https://graphics.stanford.edu/~seander/bithacks.html#ZeroInWord
+// and mixing the word into the hash.
+func scanName(b []byte) (int, uint64) {
+	hash := uint64(fnv1aOffset64)
+	i := 0
+	for ; i+8 <= len(b); i += 8 {
+		w := binary.LittleEndian.Uint64(b[i:])
+		x := w ^ semicolons
+		if found := (x - lowBits) &^ x & highBits; found != 0 {
+			n := bits.TrailingZeros64(found) >> 3
+			if n > 0 {
+				hash ^= w & (1<<(n*8) - 1)
+				hash *= fnv1aPrime64
+			}
+			return i + n, mix(hash)
+		}
+		hash ^= w
+		hash *= fnv1aPrime64
+	}
+
+	var w uint64
+	n := 0
+	for ; i+n < len(b) && b[i+n] != ';'; n++ {
+		w |= uint64(b[i+n]) << (n * 8)
+	}
+	if n > 0 {
+		hash ^= w
+		hash *= fnv1aPrime64
+	}
+	return i + n, mix(hash)
+}
+
+// mix spreads all bits of hash to its low bits that are used to index the table.
+func mix(hash uint64) uint64 {
+	hash ^= hash >> 33
+	hash *= mixMultiplier
+	return hash ^ hash>>33
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func hashName(name []byte) uint64 {
+	_, hash := scanName(name)
+	return hash
+}
+
+func TestStatsTable(t *testing.T) {
+	table := newStatsTable(3)
+
+	// use the same hash to exercise probing
+	for _, name := range []string{"a", "b", "a", "c", "b", "a"} {
+		stats := table.get(42, []byte(name))
+		if stats == nil {
+			t.Fatalf("Unexpected nil stats for %s", name)
+		}
+		stats.add(int16(name[0]))
+	}
+	if table.get(42, []byte("d")) != nil {
+		t.Errorf("Expected nil stats for a name over the limit")
+	}
+
+	other := newStatsTable(3)
+	other.get(hashName([]byte("a")), []byte("a")).add(1)
+	if table.merge(other) {
+		t.Errorf("Expected merge over the limit to fail")
+	}
+
+	stats := table.toMap()
+	for name, expected := range map[string]int64{"a": 3, "b": 2, "c": 1} {
+		if stats[name] == nil || stats[name].count != expected {
+			t.Errorf("Wrong stats of %s, expected count: %d, got: %v", name, expected, stats[name])
+		}
+	}
+}
+
+func TestStatsTableLongName(t *testing.T) {
+	table := newStatsTable(MAX_CITY_NUM)
+
+	name := bytes.Repeat([]byte("x"), MAX_NAME_LEN)
+	if table.get(hashName(name), name) == nil {
+		t.Errorf("Expected stats for a name of %d bytes", len(name))
+	}
+
+	name = append(name, 'x')
+	if table.get(hashName(name), name) != nil {
+		t.Errorf("Expected nil stats for a name of %d bytes", len(name))
+	}
+}
+
+// processLinesWithMap is the map based implementation replaced by statsTable,
+// kept to benchmark against.
+func processLinesWithMap(data []byte) map[string]*TemperatureStats {
+	stats := make(map[string]*TemperatureStats, MAX_CITY_NUM)
+
+	offset := 0
+	for offset < len(data) {
+		newLinePos := bytes.IndexByte(data[offset:], '\n')
+		line := data[offset : offset+newLinePos]
+		cityB, temperatureB, _ := bytes.Cut(line, []byte(";"))
+		temperature, _ := parseTemperature(temperatureB)
+
+		recording, exists := stats[string(cityB)]
+		if !exists {
+			recording = &TemperatureStats{}
+			stats[string(cityB)] = recording
+		}
+		recording.add(temperature)
+
+		offset += newLinePos + 1
+	}
+	return stats
+}
+
+// benchmarkData returns about 16MB of measurements made of repeated sample rows.
+func benchmarkData(b *testing.B, sample string) []byte {
+	data, err := os.ReadFile(filepath.Join(samplesDir, sample))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return bytes.Repeat(data, 16<<20/len(data))
+}
+
+// Compare CPU profiles of both with e.g.
+//
+//	go test -run=^$ -bench=ProcessLines/.*/map -cpuprofile=profiles/map.out
+//	go test -run=^$ -bench=ProcessLines/.*/table -cpuprofile=profiles/table.out
+func BenchmarkProcessLines(b *testing.B) {
+	for _, sample := range []string{"measurements-10000-unique-keys.txt", "measurements-complex-utf8.txt"} {
+		data := benchmarkData(b, sample)
+
+		b.Run(sample+"/map", func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				processLinesWithMap(data)
+			}
+		})
+
+		b.Run(sample+"/table", func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				processLines(Block{data: data}, newStatsTable(MAX_CITY_NUM))
+			}
+		})
+	}
+}
+
+func TestProcessLinesWithMap(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join(samplesDir, "measurements-10000-unique-keys.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := processLinesWithMap(data)
+	stats, err := calculate(data, 4, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for city, recording := range expected {
+		if got := stats[city]; got == nil || fmt.Sprint(got.min, got.max, got.sum, got.count) != fmt.Sprint(recording.min, recording.max, recording.sum, recording.count) {
+			t.Errorf("Wrong stats of %s, expected: %v, got: %v", city, recording, got)
+		}
+	}
+}